@@ -1,7 +1,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/BurntSushi/toml"
+	"github.com/bardex/minipic/internal/app"
+	"github.com/bardex/minipic/internal/httpserver"
 )
 
 type Config struct {
@@ -12,6 +20,215 @@ type Config struct {
 		Limit     int
 		Directory string
 	}
+	Downloader struct {
+		MaxSize         int64    `toml:"max_size"`
+		AllowedHosts    []string `toml:"allowed_hosts"`
+		AllowedNetworks []string `toml:"allowed_networks"`
+		LocalRoot       string   `toml:"local_root"`
+		Retries         int
+		RetryDelay      duration `toml:"retry_delay"`
+		RetryMaxDelay   duration `toml:"retry_max_delay"`
+		BreakerFailures int      `toml:"breaker_failures"`
+		BreakerCooldown duration `toml:"breaker_cooldown"`
+
+		Timeout             duration
+		ConnectTimeout      duration `toml:"connect_timeout"`
+		TLSTimeout          duration `toml:"tls_timeout"`
+		MaxIdleConns        int      `toml:"max_idle_conns"`
+		MaxIdleConnsPerHost int      `toml:"max_idle_conns_per_host"`
+		MaxConnsPerHost     int      `toml:"max_conns_per_host"`
+		IdleConnTimeout     duration `toml:"idle_conn_timeout"`
+		Proxy               string
+		CAFile              string `toml:"ca_file"`
+		InsecureSkipVerify  bool   `toml:"insecure_skip_verify"`
+		UserAgent           string `toml:"user_agent"`
+	}
+	Headers struct {
+		RequestAllow  []string `toml:"request_allow"`
+		RequestDeny   []string `toml:"request_deny"`
+		ResponseAllow []string `toml:"response_allow"`
+		ResponseDeny  []string `toml:"response_deny"`
+		Hosts         map[string]map[string]string
+	}
+	Auth    map[string]Credentials
+	Metrics struct {
+		Listen string
+	}
+	Upload struct {
+		MaxSize int64 `toml:"max_size"`
+	}
+	Origins     map[string]Origin
+	Placeholder struct {
+		Path string
+		TTL  duration
+	}
+	S3 struct {
+		Enabled        bool
+		AllowAnyBucket bool `toml:"allow_any_bucket"`
+		S3Bucket
+		Buckets map[string]S3Bucket
+	}
+	Sources struct {
+		Allow []string
+		Deny  []string
+	}
+	Signature struct {
+		Keys   map[string]string
+		Unsafe bool
+	}
+	Srcset struct {
+		Breakpoints []int
+		Sizes       string
+		BaseURL     string `toml:"base_url"`
+	}
+	Resizer struct {
+		ColorProfile    string `toml:"color_profile"`
+		Metadata        string
+		Progressive     bool
+		Palette         int
+		MaxSourcePixels int `toml:"max_source_pixels"`
+		MaxOutputPixels int `toml:"max_output_pixels"`
+	}
+}
+
+// ClientOptions returns the settings of the HTTP client of the downloaders.
+func (c Config) ClientOptions() (app.ClientOptions, error) {
+	d := c.Downloader
+	opts := app.ClientOptions{
+		ConnectTimeout:      time.Duration(d.ConnectTimeout),
+		TLSTimeout:          time.Duration(d.TLSTimeout),
+		MaxIdleConns:        d.MaxIdleConns,
+		MaxIdleConnsPerHost: d.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     d.MaxConnsPerHost,
+		IdleConnTimeout:     time.Duration(d.IdleConnTimeout),
+		InsecureSkipVerify:  d.InsecureSkipVerify,
+		UserAgent:           d.UserAgent,
+	}
+	if d.Proxy != "" {
+		proxy, err := url.Parse(d.Proxy)
+		if err != nil {
+			return opts, err
+		}
+		opts.Proxy = proxy
+	}
+	if d.CAFile != "" {
+		pool, err := app.LoadCertPool(d.CAFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.RootCAs = pool
+	}
+	return opts, nil
+}
+
+// HeaderPolicies returns the policies of the forwarded request and response headers,
+// the lists which are not set keep the defaults.
+func (c Config) HeaderPolicies() (request, response httpserver.HeaderPolicy) {
+	request, response = httpserver.DefaultRequestHeaders, httpserver.DefaultResponseHeaders
+	if c.Headers.RequestAllow != nil {
+		request.Allow = c.Headers.RequestAllow
+	}
+	if c.Headers.RequestDeny != nil {
+		request.Deny = c.Headers.RequestDeny
+	}
+	if c.Headers.ResponseAllow != nil {
+		response.Allow = c.Headers.ResponseAllow
+	}
+	if c.Headers.ResponseDeny != nil {
+		response.Deny = c.Headers.ResponseDeny
+	}
+	return request, response
+}
+
+// Origin the image origin requested as @<name>/<path>.
+type Origin struct {
+	Base      string
+	Headers   map[string]string
+	Timeout   duration
+	Fallbacks []string
+	Auth      Credentials
+}
+
+// Credentials the credentials of the image host or origin.
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+	Headers  map[string]string
+}
+
+// validate checks that the credentials use a single authentication scheme, the error does not contain the secrets.
+func (c Credentials) validate() error {
+	if c.Token != "" && (c.Username != "" || c.Password != "") {
+		return errors.New("token and username/password must not be set together")
+	}
+	return nil
+}
+
+// AppCredentials returns the credentials of the hosts for app.WithCredentials.
+func (c Config) AppCredentials() map[string]app.Credentials {
+	credentials := make(map[string]app.Credentials, len(c.Auth))
+	for host, auth := range c.Auth {
+		credentials[host] = app.Credentials(auth)
+	}
+	return credentials
+}
+
+// duration the duration in the config, e.g. "5s" or "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// AppOrigins returns the origins for app.NewOriginDownloader.
+func (c Config) AppOrigins() map[string]app.Origin {
+	origins := make(map[string]app.Origin, len(c.Origins))
+	for name, o := range c.Origins {
+		origins[name] = app.Origin{
+			Base:      o.Base,
+			Headers:   o.Headers,
+			Timeout:   time.Duration(o.Timeout),
+			Fallbacks: o.Fallbacks,
+			Auth:      app.Credentials(o.Auth),
+		}
+	}
+	return origins
+}
+
+// S3Bucket the location and credentials of the S3 buckets, the empty settings of the bucket are taken from [s3].
+type S3Bucket struct {
+	Endpoint  string
+	Region    string
+	PathStyle bool   `toml:"path_style"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+}
+
+// S3Buckets returns the default settings and the settings of the buckets for app.NewS3Downloader.
+func (c Config) S3Buckets() (app.S3Bucket, map[string]app.S3Bucket) {
+	defaults := app.S3Bucket(c.S3.S3Bucket)
+	buckets := make(map[string]app.S3Bucket, len(c.S3.Buckets))
+	for name, b := range c.S3.Buckets {
+		bucket := app.S3Bucket(b)
+		if bucket.Endpoint == "" {
+			bucket.Endpoint = defaults.Endpoint
+		}
+		if bucket.Region == "" {
+			bucket.Region = defaults.Region
+		}
+		bucket.PathStyle = bucket.PathStyle || defaults.PathStyle
+		if bucket.AccessKey == "" {
+			bucket.AccessKey, bucket.SecretKey = defaults.AccessKey, defaults.SecretKey
+		}
+		buckets[name] = bucket
+	}
+	return defaults, buckets
 }
 
 func NewConfig(configPath string) (Config, error) {
@@ -19,5 +236,110 @@ func NewConfig(configPath string) (Config, error) {
 	if _, err := toml.DecodeFile(configPath, &config); err != nil {
 		return config, err
 	}
+
+	switch config.Resizer.ColorProfile {
+	case "", app.ProfileStrip, app.ProfileKeep, app.ProfileSRGB:
+	default:
+		return config, fmt.Errorf(
+			"resizer.color_profile must be `%s`, `%s` or `%s`", app.ProfileStrip, app.ProfileKeep, app.ProfileSRGB,
+		)
+	}
+	switch config.Resizer.Metadata {
+	case "", app.MetadataStrip, app.MetadataKeep:
+	default:
+		return config, fmt.Errorf("resizer.metadata must be `%s` or `%s`", app.MetadataStrip, app.MetadataKeep)
+	}
+
+	if config.Resizer.Palette < 0 || config.Resizer.Palette == 1 || config.Resizer.Palette > 256 {
+		return config, errors.New("resizer.palette must be 0 or number of colors from 2 to 256")
+	}
+
+	if config.Downloader.Retries < 0 || config.Downloader.RetryDelay < 0 || config.Downloader.RetryMaxDelay < 0 {
+		return config, errors.New("downloader.retries, retry_delay and retry_max_delay must not be negative")
+	}
+	if config.Downloader.BreakerFailures < 0 || config.Downloader.BreakerCooldown < 0 {
+		return config, errors.New("downloader.breaker_failures and breaker_cooldown must not be negative")
+	}
+
+	d := config.Downloader
+	if d.Timeout < 0 || d.ConnectTimeout < 0 || d.TLSTimeout < 0 || d.IdleConnTimeout < 0 {
+		return config, errors.New("downloader timeouts must not be negative")
+	}
+	if d.MaxIdleConns < 0 || d.MaxIdleConnsPerHost < 0 || d.MaxConnsPerHost < 0 {
+		return config, errors.New("downloader connection limits must not be negative")
+	}
+	if d.Proxy != "" {
+		u, err := url.Parse(d.Proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return config, errors.New("downloader.proxy must be absolute http(s) URL")
+		}
+	}
+
+	sources := httpserver.SourcePolicy{Allow: config.Sources.Allow, Deny: config.Sources.Deny}
+	if err := sources.Validate(); err != nil {
+		return config, fmt.Errorf("sources: %w", err)
+	}
+
+	for _, width := range config.Srcset.Breakpoints {
+		if width < 10 {
+			return config, errors.New("srcset.breakpoints must be at least 10px")
+		}
+	}
+
+	for name, origin := range config.Origins {
+		if name == "" || strings.Contains(name, "/") {
+			return config, fmt.Errorf("origins: name %q must not be empty or contain `/`", name)
+		}
+		u, err := url.Parse(origin.Base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return config, fmt.Errorf("origins.%s: base must be absolute http(s) URL", name)
+		}
+		if origin.Timeout < 0 {
+			return config, fmt.Errorf("origins.%s: timeout must not be negative", name)
+		}
+		if err := origin.Auth.validate(); err != nil {
+			return config, fmt.Errorf("origins.%s.auth: %w", name, err)
+		}
+		for _, fallback := range origin.Fallbacks {
+			if _, ok := config.Origins[fallback]; !ok || fallback == name {
+				return config, fmt.Errorf("origins.%s: fallback %q must be another origin", name, fallback)
+			}
+		}
+	}
+
+	for host, auth := range config.Auth {
+		if err := auth.validate(); err != nil {
+			return config, fmt.Errorf("auth.%s: %w", host, err)
+		}
+	}
+
+	if config.Placeholder.TTL < 0 {
+		return config, errors.New("placeholder.ttl must not be negative")
+	}
+	if config.Placeholder.TTL == 0 {
+		config.Placeholder.TTL = duration(time.Minute)
+	}
+
+	if config.S3.AccessKey != "" && config.S3.SecretKey == "" {
+		return config, errors.New("s3: secret_key must not be empty")
+	}
+	if config.S3.Enabled && len(config.S3.Buckets) == 0 && !config.S3.AllowAnyBucket {
+		return config, errors.New("s3: buckets must not be empty unless allow_any_bucket is set")
+	}
+	for name, bucket := range config.S3.Buckets {
+		if bucket.AccessKey != "" && bucket.SecretKey == "" {
+			return config, fmt.Errorf("s3.buckets.%s: secret_key must not be empty", name)
+		}
+	}
+
+	for id, key := range config.Signature.Keys {
+		if id == "" || strings.ContainsAny(id, "./") {
+			return config, fmt.Errorf("signature.keys: key ID %q must not be empty or contain `.` and `/`", id)
+		}
+		if key == "" {
+			return config, fmt.Errorf("signature.keys: key %q must not be empty", id)
+		}
+	}
+
 	return config, nil
 }
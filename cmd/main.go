@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -32,13 +35,106 @@ func main() {
 		log.Fatalf("Fail loading configuration:%s", err)
 	}
 
+	allowedNetworks, err := app.ParseNetworks(cfg.Downloader.AllowedNetworks)
+	if err != nil {
+		log.Fatalf("Fail parsing downloader.allowed_networks:%s", err)
+	}
+
+	clientOpts, err := cfg.ClientOptions()
+	if err != nil {
+		log.Fatalf("Fail configuring downloader:%s", err)
+	}
+
+	downloaderOpts := []app.DownloaderOption{
+		app.WithAllowedTargets(cfg.Downloader.AllowedHosts, allowedNetworks),
+		app.WithMaxSize(cfg.Downloader.MaxSize),
+		app.WithClient(clientOpts),
+		app.WithHostHeaders(cfg.Headers.Hosts),
+		app.WithCredentials(cfg.AppCredentials()),
+		app.WithRetry(app.RetryPolicy{
+			Retries:  cfg.Downloader.Retries,
+			Delay:    time.Duration(cfg.Downloader.RetryDelay),
+			MaxDelay: time.Duration(cfg.Downloader.RetryMaxDelay),
+		}),
+	}
+	var metrics []httpserver.MetricsWriter
+	if cfg.Downloader.BreakerFailures > 0 {
+		breaker := app.NewCircuitBreaker(cfg.Downloader.BreakerFailures, time.Duration(cfg.Downloader.BreakerCooldown))
+		downloaderOpts = append(downloaderOpts, app.WithCircuitBreaker(breaker))
+		metrics = append(metrics, breaker)
+	}
+
+	remote := app.NewImageDownloader(downloaderOpts...)
+	downloader := app.SchemeDownloader{"http": remote, "https": remote}
+
+	requestHeaders, responseHeaders := cfg.HeaderPolicies()
+
+	var cache *app.LruCache
+	handlerOpts := []httpserver.HandlerOption{
+		httpserver.WithHasher(app.Hasher{MaxSourcePixels: cfg.Resizer.MaxSourcePixels}),
+		httpserver.WithDefaults(httpserver.ResizeOptions{
+			Progressive: cfg.Resizer.Progressive,
+			Palette:     cfg.Resizer.Palette,
+		}),
+		httpserver.WithSourcePolicy(httpserver.SourcePolicy{
+			Allow: cfg.Sources.Allow,
+			Deny:  cfg.Sources.Deny,
+		}),
+		httpserver.WithSignature(cfg.Signature.Keys, cfg.Signature.Unsafe),
+		httpserver.WithTimeout(time.Duration(cfg.Downloader.Timeout)),
+		httpserver.WithHeaderPolicy(requestHeaders, responseHeaders),
+		httpserver.WithUpload(cfg.Upload.MaxSize),
+		httpserver.WithSrcset(app.Inspector{}, httpserver.Srcset{
+			Breakpoints: cfg.Srcset.Breakpoints,
+			Sizes:       cfg.Srcset.Sizes,
+			BaseURL:     cfg.Srcset.BaseURL,
+		}),
+	}
+	if cfg.Downloader.LocalRoot != "" {
+		maxSize := app.WithMaxSize(cfg.Downloader.MaxSize)
+		downloader[app.LocalScheme] = app.NewLocalDownloader(cfg.Downloader.LocalRoot, maxSize)
+		handlerOpts = append(handlerOpts, httpserver.WithSchemes(app.LocalScheme))
+	}
+	if len(cfg.Origins) > 0 {
+		origins := cfg.AppOrigins()
+		downloader[httpserver.OriginScheme] = app.NewOriginDownloader(origins, downloaderOpts...)
+		for name := range origins {
+			handlerOpts = append(handlerOpts, httpserver.WithOrigins(name))
+		}
+	}
+	if cfg.S3.Enabled {
+		defaults, buckets := cfg.S3Buckets()
+		downloader[app.S3Scheme] = app.NewS3Downloader(defaults, buckets, cfg.S3.AllowAnyBucket, downloaderOpts...)
+		handlerOpts = append(handlerOpts, httpserver.WithSchemes(app.S3Scheme))
+	}
+	if cfg.Placeholder.Path != "" {
+		image, err := os.ReadFile(cfg.Placeholder.Path)
+		if err != nil {
+			log.Fatalf("Fail reading placeholder.path:%s", err)
+		}
+		if _, err := (app.Inspector{}).Inspect(bytes.NewReader(image)); err != nil {
+			log.Fatalf("Fail reading placeholder.path:%s", err)
+		}
+		handlerOpts = append(handlerOpts, httpserver.WithPlaceholder(image, time.Duration(cfg.Placeholder.TTL)))
+	}
+	if cfg.Cache.Limit > 0 {
+		cache = app.NewLruCache(cfg.Cache.Directory, cfg.Cache.Limit)
+		handlerOpts = append(handlerOpts, httpserver.WithCache(cache))
+	}
+
 	h := httpserver.NewHandler(
-		app.NewImageDownloader(),
-		app.Resizer{},
+		downloader,
+		app.Resizer{
+			ColorProfile:    cfg.Resizer.ColorProfile,
+			Metadata:        cfg.Resizer.Metadata,
+			MaxSourcePixels: cfg.Resizer.MaxSourcePixels,
+			MaxOutputPixels: cfg.Resizer.MaxOutputPixels,
+		},
+		handlerOpts...,
 	)
 
-	if cfg.Cache.Limit > 0 {
-		h = middleware.NewCache(app.NewLruCache(cfg.Cache.Directory, cfg.Cache.Limit), h)
+	if cache != nil {
+		h = middleware.NewCache(cache, h)
 	}
 
 	server := httpserver.NewServer(cfg.Server.Listen, h)
@@ -50,6 +146,17 @@ func main() {
 		}
 	}()
 
+	var metricsServer *httpserver.Server
+	if cfg.Metrics.Listen != "" {
+		metricsServer = httpserver.NewServer(cfg.Metrics.Listen, httpserver.NewMetricsHandler(metrics...))
+		go func() {
+			log.Printf("metrics listening on %s...\n", cfg.Metrics.Listen)
+			if err := metricsServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalln(err)
+			}
+		}()
+	}
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	<-done
@@ -61,4 +168,9 @@ func main() {
 	if err := server.Stop(ctx); err != nil {
 		log.Println("failed to stop http server: " + err.Error())
 	}
+	if metricsServer != nil {
+		if err := metricsServer.Stop(ctx); err != nil {
+			log.Println("failed to stop metrics server: " + err.Error())
+		}
+	}
 }
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bardex/minipic/internal/httpserver"
+)
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+
+	// maxBreakerHosts limits the number of the failing hosts tracked by the breaker,
+	// the image URLs come from the clients, so the number of the hosts is not limited.
+	maxBreakerHosts = 10000
+)
+
+// CircuitBreaker fails fast the downloads from the hosts which failed several times in a row.
+// After the cooldown one probe download is allowed, it closes the breaker on success or opens it again on failure.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+type hostBreaker struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker returns the breaker which opens after threshold consecutive failures of the host for cooldown.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		hosts:     make(map[string]*hostBreaker),
+	}
+}
+
+// WithCircuitBreaker fails fast the downloads from the failing hosts, the breaker may be shared by the downloaders.
+func WithCircuitBreaker(breaker *CircuitBreaker) DownloaderOption {
+	return func(d *SimpleImageDownloader) {
+		d.breaker = breaker
+	}
+}
+
+func (b *CircuitBreaker) state(host *hostBreaker) int {
+	switch {
+	case host.failures < b.threshold:
+		return breakerClosed
+	case b.now().Sub(host.openedAt) < b.cooldown:
+		return breakerOpen
+	}
+	return breakerHalfOpen
+}
+
+// allow returns ErrSourceUnavailable if the download from the host must fail fast.
+func (b *CircuitBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.hosts[host]
+	if !ok {
+		return nil
+	}
+	switch b.state(h) {
+	case breakerOpen:
+		return fmt.Errorf("%w: %s failed %d times in a row", httpserver.ErrSourceUnavailable, host, h.failures)
+	case breakerHalfOpen:
+		if h.probing {
+			return fmt.Errorf("%w: %s is being probed", httpserver.ErrSourceUnavailable, host)
+		}
+		h.probing = true
+	}
+	return nil
+}
+
+// record counts the result of the allowed download.
+func (b *CircuitBreaker) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.hosts[host]
+	if !failed {
+		delete(b.hosts, host)
+		return
+	}
+	if !ok {
+		if len(b.hosts) >= maxBreakerHosts {
+			return
+		}
+		h = &hostBreaker{}
+		b.hosts[host] = h
+	}
+	h.probing = false
+	h.failures++
+	if h.failures >= b.threshold {
+		h.openedAt = b.now()
+	}
+}
+
+// cancel forgets the allowed download which was canceled by the client.
+func (b *CircuitBreaker) cancel(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if h, ok := b.hosts[host]; ok {
+		h.probing = false
+	}
+}
+
+// WriteMetrics writes the state of the breaker in the Prometheus text format.
+func (b *CircuitBreaker) WriteMetrics(w io.Writer) error {
+	b.mu.Lock()
+	hosts := make([]string, 0, len(b.hosts))
+	for host := range b.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	states := make([]int, len(hosts))
+	failures := make([]int, len(hosts))
+	for i, host := range hosts {
+		states[i] = b.state(b.hosts[host])
+		failures[i] = b.hosts[host].failures
+	}
+	b.mu.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("# HELP minipic_downloader_breaker_state " +
+		"State of the circuit breaker of the image host: 0 - closed, 1 - half-open, 2 - open.\n")
+	sb.WriteString("# TYPE minipic_downloader_breaker_state gauge\n")
+	for i, host := range hosts {
+		fmt.Fprintf(&sb, "minipic_downloader_breaker_state{host=\"%s\"} %d\n", labelValue(host), states[i])
+	}
+	sb.WriteString("# HELP minipic_downloader_breaker_failures Consecutive failed downloads from the image host.\n")
+	sb.WriteString("# TYPE minipic_downloader_breaker_failures gauge\n")
+	for i, host := range hosts {
+		fmt.Fprintf(&sb, "minipic_downloader_breaker_failures{host=\"%s\"} %d\n", labelValue(host), failures[i])
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue escapes the label value of the Prometheus text format.
+func labelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
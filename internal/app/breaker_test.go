@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bardex/minipic/internal/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// the failures below the threshold and the successes keep the breaker closed
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.allow("a"))
+		b.record("a", true)
+	}
+	require.NoError(t, b.allow("a"))
+	b.record("a", false)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.allow("a"))
+		b.record("a", true)
+	}
+
+	err := b.allow("a")
+	require.ErrorIs(t, err, httpserver.ErrSourceUnavailable)
+	require.NoError(t, b.allow("b"))
+
+	// a single probe after the cooldown, its failure opens the breaker again
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow("a"))
+	require.ErrorIs(t, b.allow("a"), httpserver.ErrSourceUnavailable)
+	b.record("a", true)
+	require.ErrorIs(t, b.allow("a"), httpserver.ErrSourceUnavailable)
+
+	// the canceled probe is retried
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow("a"))
+	b.cancel("a")
+	require.NoError(t, b.allow("a"))
+
+	var metrics strings.Builder
+	require.NoError(t, b.WriteMetrics(&metrics))
+	require.Contains(t, metrics.String(), "minipic_downloader_breaker_state{host=\"a\"} 1\n")
+	require.Contains(t, metrics.String(), "minipic_downloader_breaker_failures{host=\"a\"} 4\n")
+
+	// the successful probe closes the breaker
+	b.record("a", false)
+	require.NoError(t, b.allow("a"))
+	metrics.Reset()
+	require.NoError(t, b.WriteMetrics(&metrics))
+	require.NotContains(t, metrics.String(), "host=\"a\"")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Retries: 5, Delay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			delay := p.backoff(retry)
+			require.GreaterOrEqual(t, int64(delay), int64(max/2), retry)
+			require.LessOrEqual(t, int64(delay), int64(max), retry)
+		}
+	}
+	require.Zero(t, RetryPolicy{}.backoff(3))
+}
+
+func TestRetryTransient(t *testing.T) {
+	dial := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/", Err: &net.OpError{Op: "dial", Err: err}}
+	}
+	tests := []struct {
+		name      string
+		status    int
+		err       error
+		transient bool
+	}{
+		{name: "refused", err: dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)), transient: true},
+		{name: "reset", err: dial(os.NewSyscallError("read", syscall.ECONNRESET)), transient: true},
+		{name: "timeout", err: dial(os.ErrDeadlineExceeded), transient: true},
+		{name: "unknown host", err: dial(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true})},
+		{name: "tls", err: &url.Error{Op: "Get", URL: "https://example.com/", Err: x509.UnknownAuthorityError{}}},
+		{name: "forbidden address", err: dial(httpserver.ErrForbiddenAddress)},
+		{name: "too large", err: httpserver.ErrSourceTooLarge},
+		{name: "canceled", err: &url.Error{Op: "Get", URL: "https://example.com/", Err: context.Canceled}},
+		{name: "bad gateway", status: http.StatusBadGateway, transient: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, transient: true},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, transient: true},
+		{name: "too many requests", status: http.StatusTooManyRequests},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "internal error", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var res *http.Response
+			if tt.err == nil {
+				res = &http.Response{StatusCode: tt.status}
+			}
+			require.Equal(t, tt.transient, transient(res, tt.err))
+		})
+	}
+}
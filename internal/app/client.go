@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ClientOptions the settings of the HTTP client of the downloader, the zero values keep the defaults.
+type ClientOptions struct {
+	// ConnectTimeout limits establishing of the TCP connection, 30s by default.
+	ConnectTimeout time.Duration
+	// TLSTimeout limits the TLS handshake, 10s by default.
+	TLSTimeout time.Duration
+	// MaxIdleConns limits the idle connections to all hosts, 10 by default.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits the idle connections to a host, 2 by default.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the connections to a host, the downloads wait for a free connection, no limit by default.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes the idle connections, 30s by default.
+	IdleConnTimeout time.Duration
+	// Proxy the HTTP proxy, no proxy by default.
+	Proxy *url.URL
+	// RootCAs the certificate authorities of the hosts, the system ones by default.
+	RootCAs *x509.CertPool
+	// InsecureSkipVerify does not verify the certificates of the hosts.
+	InsecureSkipVerify bool
+	// UserAgent replaces the User-Agent of the client.
+	UserAgent string
+}
+
+// WithClient configures the HTTP client of the downloader.
+func WithClient(opts ClientOptions) DownloaderOption {
+	return func(d *SimpleImageDownloader) {
+		d.clientOpts = opts
+	}
+}
+
+// LoadCertPool returns the system certificate authorities with the ones from the PEM file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+	return pool, nil
+}
+
+func (o ClientOptions) dialer() *net.Dialer {
+	timeout := o.ConnectTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+}
+
+func (o ClientOptions) transport(
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) *http.Transport {
+	t := &http.Transport{
+		DialContext:         dial,
+		TLSHandshakeTimeout: o.TLSTimeout,
+		MaxIdleConns:        o.MaxIdleConns,
+		MaxIdleConnsPerHost: o.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     o.MaxConnsPerHost,
+		IdleConnTimeout:     o.IdleConnTimeout,
+	}
+	if t.TLSHandshakeTimeout <= 0 {
+		t.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if t.MaxIdleConns <= 0 {
+		t.MaxIdleConns = 10
+	}
+	if t.IdleConnTimeout <= 0 {
+		t.IdleConnTimeout = 30 * time.Second
+	}
+	if o.RootCAs != nil || o.InsecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{
+			RootCAs:            o.RootCAs,
+			InsecureSkipVerify: o.InsecureSkipVerify, //nolint:gosec // configured for the internal hosts
+		}
+	}
+	if o.Proxy != nil {
+		t.Proxy = http.ProxyURL(o.Proxy)
+	}
+	return t
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"encoding/base64"
+	"net/http"
+)
+
+// Credentials the credentials injected by the downloader into the requests to the host or origin.
+// They are never taken from the client and are redacted when formatted.
+type Credentials struct {
+	// Username and Password the basic authentication.
+	Username string
+	Password string
+	// Token the bearer token.
+	Token string
+	// Headers the custom headers, e.g. X-Api-Key.
+	Headers map[string]string
+}
+
+// WithCredentials injects the credentials into the requests to the hosts, e.g. {"cdn.example.com": {Token: "secret"}}.
+// The credentials replace the static headers of the host with the same names
+// and are removed when the host redirects to another host.
+func WithCredentials(hosts map[string]Credentials) DownloaderOption {
+	return func(d *SimpleImageDownloader) {
+		if d.hostCredentials == nil {
+			d.hostCredentials = make(map[string]http.Header, len(hosts))
+		}
+		for host, credentials := range hosts {
+			mergeHostHeaders(d.hostCredentials, host, credentials.header())
+		}
+	}
+}
+
+// header returns the headers with the credentials.
+func (c Credentials) header() http.Header {
+	headers := make(http.Header, len(c.Headers)+1)
+	switch {
+	case c.Token != "":
+		headers.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "" || c.Password != "":
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)))
+	}
+	for k, v := range c.Headers {
+		headers.Set(k, v)
+	}
+	return headers
+}
+
+func (c Credentials) String() string {
+	return "[REDACTED]"
+}
+
+func (c Credentials) GoString() string {
+	return "app.Credentials{[REDACTED]}"
+}
+
+// clientHeaders returns the copy of the headers of the client without the credentials,
+// the credentials of the image hosts are injected by the downloader only.
+func clientHeaders(headers http.Header) http.Header {
+	headers = headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Del("Authorization")
+	headers.Del("Proxy-Authorization")
+	return headers
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials Credentials
+		headers     http.Header
+	}{
+		{name: "none", credentials: Credentials{}, headers: http.Header{}},
+		{
+			name:        "basic",
+			credentials: Credentials{Username: "user", Password: "pass"},
+			headers:     http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}},
+		},
+		{name: "bearer", credentials: Credentials{Token: "secret"}, headers: http.Header{"Authorization": {"Bearer secret"}}},
+		{
+			name:        "custom headers",
+			credentials: Credentials{Token: "secret", Headers: map[string]string{"x-api-key": "key"}},
+			headers:     http.Header{"Authorization": {"Bearer secret"}, "X-Api-Key": {"key"}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.headers, tt.credentials.header())
+		})
+	}
+
+	// the credentials are redacted when formatted
+	origin := Origin{
+		Base: "https://cdn.example.com/",
+		Auth: Credentials{Username: "user", Password: "pass", Token: "token", Headers: map[string]string{"X-Api-Key": "key"}},
+	}
+	bucket := S3Bucket{AccessKey: "minio", SecretKey: "minio123"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		for _, formatted := range []string{fmt.Sprintf(format, origin), fmt.Sprintf(format, bucket)} {
+			for _, secret := range []string{"pass", "token", "key", "minio123"} {
+				require.NotContains(t, formatted, secret, format)
+			}
+		}
+	}
+
+	_, err := Origin{Base: "//user:pass@/img/"}.imageURL("/a.jpeg", "")
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "pass")
+
+	// the credentials of the client are removed
+	client := http.Header{
+		"Authorization":       {"Bearer client"},
+		"Proxy-Authorization": {"Basic client"},
+		"User-Agent":          {"Firefox"},
+	}
+	require.Equal(t, http.Header{"User-Agent": {"Firefox"}}, clientHeaders(client))
+	require.Equal(t, "Bearer client", client.Get("Authorization"))
+}
+
+func TestHostHeadersAndCredentials(t *testing.T) {
+	headers := WithHostHeaders(map[string]map[string]string{
+		"cdn.example.com": {"X-Api-Key": "static", "X-Tenant": "shop"},
+		"img.example.com": {"X-Tenant": "blog"},
+	})
+	moreHeaders := WithHostHeaders(map[string]map[string]string{"CDN.example.com": {"X-Region": "eu"}})
+	credentials := WithCredentials(map[string]Credentials{
+		"cdn.example.com": {Token: "secret", Headers: map[string]string{"X-Api-Key": "key"}},
+	})
+	expected := http.Header{
+		"Authorization": {"Bearer secret"},
+		"X-Api-Key":     {"key"},
+		"X-Tenant":      {"shop"},
+		"X-Region":      {"eu"},
+	}
+
+	// the result does not depend on the order of the options
+	for _, opts := range [][]DownloaderOption{
+		{headers, moreHeaders, credentials},
+		{credentials, headers, moreHeaders},
+		{moreHeaders, credentials, headers},
+	} {
+		d := NewImageDownloader(opts...)
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "https://cdn.example.com/a.jpeg", nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, d.withStaticHeaders(req, nil).Header)
+
+		req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, "https://img.example.com/a.jpeg", nil)
+		require.NoError(t, err)
+		require.Equal(t, http.Header{"X-Tenant": {"blog"}}, d.withStaticHeaders(req, nil).Header)
+	}
+}
@@ -2,30 +2,136 @@ package app
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"time"
+	"net/url"
+	"strings"
+
+	"github.com/bardex/minipic/internal/httpserver"
 )
 
 type SimpleImageDownloader struct {
-	client *http.Client
+	client          *http.Client
+	maxSize         int64
+	allowedHosts    map[string]bool
+	allowedNetworks []*net.IPNet
+	retry           RetryPolicy
+	breaker         *CircuitBreaker
+	clientOpts      ClientOptions
+	hostHeaders     map[string]http.Header
+	hostCredentials map[string]http.Header
+	// trusted the downloader of the configured hosts, see newTrustedDownloader.
+	trusted bool
 }
 
-func NewImageDownloader() SimpleImageDownloader {
-	return SimpleImageDownloader{
-		client: &http.Client{
-			Transport: &http.Transport{
-				MaxIdleConns:    10,
-				IdleConnTimeout: 30 * time.Second,
-			},
-		},
+// DownloaderOption configures optional features of the SimpleImageDownloader.
+type DownloaderOption func(d *SimpleImageDownloader)
+
+// WithMaxSize limits the size of the downloaded response body in bytes.
+func WithMaxSize(maxSize int64) DownloaderOption {
+	return func(d *SimpleImageDownloader) {
+		d.maxSize = maxSize
 	}
 }
 
+func NewImageDownloader(opts ...DownloaderOption) SimpleImageDownloader {
+	d := SimpleImageDownloader{
+		allowedHosts: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(&d)
+	}
+
+	dialer := guardedDialer{
+		dialer:          d.clientOpts.dialer(),
+		resolver:        net.DefaultResolver,
+		allowedHosts:    d.allowedHosts,
+		allowedNetworks: d.allowedNetworks,
+	}
+	proxy := d.clientOpts.Proxy
+	if proxy != nil {
+		dialer.proxyHost = strings.ToLower(proxy.Hostname())
+	}
+	transport := d.clientOpts.transport(dialer.DialContext)
+	if proxy != nil {
+		// the dialer connects to the proxy, so the image host is checked before the request is sent to the proxy;
+		// the proxy resolves the host again, so the protection from DNS rebinding depends on the proxy
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := dialer.check(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return proxy, nil
+		}
+	}
+	d.client = &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+	return d
+}
+
+// newTrustedDownloader returns the downloader of the hosts configured by the administrator,
+// e.g. an origin or an object storage in the internal network, so the host of the request
+// is not checked for private addresses. The redirects to other hosts are checked as usual,
+// because the response of the host is not under control of the administrator.
+func newTrustedDownloader(opts []DownloaderOption) SimpleImageDownloader {
+	d := NewImageDownloader(opts...)
+	d.trusted = true
+	return d
+}
+
 func (d SimpleImageDownloader) Download(ctx context.Context, url string, headers http.Header) (*http.Response, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header = headers
-	return d.client.Do(req)
+	req.Header = clientHeaders(headers)
+	return d.do(req, nil)
+}
+
+// do sends the request with the static headers and limits the size of the response body.
+func (d SimpleImageDownloader) do(req *http.Request, static http.Header) (*http.Response, error) {
+	if d.trusted {
+		req = req.WithContext(context.WithValue(req.Context(), trustedHostKey{}, req.URL.Hostname()))
+	}
+	res, err := d.send(d.withStaticHeaders(req, static))
+	if err != nil {
+		return nil, err
+	}
+
+	if d.maxSize > 0 {
+		if res.ContentLength > d.maxSize {
+			res.Body.Close()
+			return nil, fmt.Errorf("%w: %d bytes exceeds %d bytes", httpserver.ErrSourceTooLarge, res.ContentLength, d.maxSize)
+		}
+		// Content-Length may be absent or wrong, so the limit is checked while streaming too
+		res.Body = &limitedBody{body: res.Body, remaining: d.maxSize, limit: d.maxSize}
+	}
+	return res, nil
+}
+
+// limitedBody fails with ErrSourceTooLarge when more than limit bytes are read.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", httpserver.ErrSourceTooLarge, b.limit)
+	}
+	// read one byte over the limit to distinguish the exact limit from the overflow
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), fmt.Errorf("%w: more than %d bytes", httpserver.ErrSourceTooLarge, b.limit)
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
 }
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"image"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/bardex/minipic/internal/httpserver"
+	"github.com/disintegration/imaging"
+)
+
+// Hasher calculates perceptual hashes of images.
+type Hasher struct {
+	// MaxSourcePixels maximum resolution (width*height) of the source image, 0 - no limit.
+	MaxSourcePixels int
+}
+
+func (h Hasher) Hash(src io.Reader) (httpserver.ImageHash, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return httpserver.ImageHash{}, err
+	}
+
+	img, _, err := decode(data, h.MaxSourcePixels)
+	if err != nil {
+		return httpserver.ImageHash{}, err
+	}
+
+	img = imaging.Grayscale(img)
+
+	return httpserver.ImageHash{
+		AHash: averageHash(img),
+		DHash: differenceHash(img),
+		PHash: perceptionHash(img),
+	}, nil
+}
+
+// averageHash compares every pixel of the 8x8 thumbnail with the mean brightness.
+func averageHash(img image.Image) uint64 {
+	pixels := grayPixels(img, 8, 8)
+
+	var sum float64
+	for _, p := range pixels {
+		sum += p
+	}
+	mean := sum / float64(len(pixels))
+
+	var hash uint64
+	for i, p := range pixels {
+		if p > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// differenceHash compares neighboring pixels in every row of the 9x8 thumbnail.
+func differenceHash(img image.Image) uint64 {
+	pixels := grayPixels(img, 9, 8)
+
+	var hash uint64
+	bit := 0
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] < pixels[y*9+x+1] {
+				hash |= 1 << uint(bit)
+			}
+			bit++
+		}
+	}
+	return hash
+}
+
+// perceptionHash compares the low frequencies of the 32x32 thumbnail DCT with their median.
+func perceptionHash(img image.Image) uint64 {
+	const size, lowSize = 32, 8
+
+	pixels := grayPixels(img, size, size)
+
+	// separable 2D DCT-II, only the low frequencies are needed
+	rows := make([]float64, size*lowSize)
+	for y := 0; y < size; y++ {
+		for u := 0; u < lowSize; u++ {
+			var sum float64
+			for x := 0; x < size; x++ {
+				sum += pixels[y*size+x] * math.Cos(math.Pi*float64(u)*(2*float64(x)+1)/(2*size))
+			}
+			rows[y*lowSize+u] = sum
+		}
+	}
+	coeffs := make([]float64, lowSize*lowSize)
+	for v := 0; v < lowSize; v++ {
+		for u := 0; u < lowSize; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				sum += rows[y*lowSize+u] * math.Cos(math.Pi*float64(v)*(2*float64(y)+1)/(2*size))
+			}
+			coeffs[v*lowSize+u] = sum
+		}
+	}
+
+	// the DC coefficient is excluded from the median because it dominates all others
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+func grayPixels(img image.Image, width, height int) []float64 {
+	thumb := imaging.Resize(img, width, height, imaging.Lanczos)
+	pixels := make([]float64, 0, width*height)
+	for i := 0; i < len(thumb.Pix); i += 4 {
+		pixels = append(pixels, float64(thumb.Pix[i]))
+	}
+	return pixels
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// maxRedirects the number of the redirects followed like by the default HTTP client.
+const maxRedirects = 10
+
+// WithHostHeaders adds the static headers to the requests to the hosts,
+// e.g. {"cdn.example.com": {"X-Api-Key": "secret"}}.
+// The headers are removed when the host redirects to another host.
+func WithHostHeaders(hosts map[string]map[string]string) DownloaderOption {
+	return func(d *SimpleImageDownloader) {
+		if d.hostHeaders == nil {
+			d.hostHeaders = make(map[string]http.Header, len(hosts))
+		}
+		for host, headers := range hosts {
+			h := make(http.Header, len(headers))
+			for k, v := range headers {
+				h.Set(k, v)
+			}
+			mergeHostHeaders(d.hostHeaders, host, h)
+		}
+	}
+}
+
+// mergeHostHeaders adds the headers to the headers of the host, the given values replace the existing ones.
+func mergeHostHeaders(hosts map[string]http.Header, host string, headers http.Header) {
+	host = strings.ToLower(host)
+	merged := hosts[host].Clone()
+	if merged == nil {
+		merged = make(http.Header, len(headers))
+	}
+	for k, v := range headers {
+		merged[k] = v
+	}
+	hosts[host] = merged
+}
+
+type staticHeadersKey struct{}
+
+// staticHeaders the headers added to the request to the host by the downloader.
+type staticHeaders struct {
+	host   string
+	header http.Header
+}
+
+// withStaticHeaders sets the headers and the credentials of the host and the given headers on the request,
+// they replace the forwarded headers of the client with the same names.
+func (d SimpleImageDownloader) withStaticHeaders(req *http.Request, static http.Header) *http.Request {
+	host := strings.ToLower(req.URL.Hostname())
+	headers := make(http.Header)
+	for k, v := range d.hostHeaders[host] {
+		headers[k] = v
+	}
+	for k, v := range d.hostCredentials[host] {
+		headers[k] = v
+	}
+	for k, v := range static {
+		headers[k] = v
+	}
+	if d.clientOpts.UserAgent != "" {
+		headers.Set("User-Agent", d.clientOpts.UserAgent)
+	}
+	if len(headers) == 0 {
+		return req
+	}
+
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	ctx := context.WithValue(req.Context(), staticHeadersKey{}, staticHeaders{host: host, header: headers})
+	return req.WithContext(ctx)
+}
+
+// checkRedirect removes the static headers of the host from the redirect to another host,
+// the client removes only Authorization and Cookie itself.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	static, ok := req.Context().Value(staticHeadersKey{}).(staticHeaders)
+	if !ok || strings.EqualFold(req.URL.Hostname(), static.host) {
+		return nil
+	}
+	for k := range static.header {
+		if k != "User-Agent" {
+			req.Header.Del(k)
+		}
+	}
+	return nil
+}
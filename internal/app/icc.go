@@ -0,0 +1,253 @@
+package app
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+)
+
+// ErrUnsupportedProfile the ICC profile can not be converted to sRGB.
+var ErrUnsupportedProfile = errors.New("unsupported ICC profile")
+
+// srgbColorants D50-adapted XYZ coordinates of the sRGB primaries (columns are red, green, blue).
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// toneCurve converts an encoded channel value in [0, 1] to the linear light.
+type toneCurve func(v float64) float64
+
+// matrixProfile RGB ICC profile described by colorants and tone curves (matrix/TRC model).
+type matrixProfile struct {
+	colorants [3][3]float64
+	curves    [3]toneCurve
+}
+
+// parseMatrixProfile parses the RGB matrix/TRC ICC profile, LUT-based profiles are not supported.
+func parseMatrixProfile(icc []byte) (matrixProfile, error) {
+	var p matrixProfile
+
+	if len(icc) < 132 || string(icc[16:20]) != "RGB " || string(icc[20:24]) != "XYZ " {
+		return p, ErrUnsupportedProfile
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(icc[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(icc) {
+			return p, ErrUnsupportedProfile
+		}
+		offset := int(binary.BigEndian.Uint32(icc[entry+4:]))
+		size := int(binary.BigEndian.Uint32(icc[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(icc) {
+			return p, ErrUnsupportedProfile
+		}
+		tags[string(icc[entry:entry+4])] = icc[offset : offset+size]
+	}
+
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[name]
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return p, ErrUnsupportedProfile
+		}
+		for j := 0; j < 3; j++ {
+			p.colorants[j][i] = s15Fixed16(tag[8+j*4:])
+			if !finite(p.colorants[j][i]) {
+				return p, ErrUnsupportedProfile
+			}
+		}
+	}
+
+	for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseToneCurve(tags[name])
+		if err != nil {
+			return p, err
+		}
+		// the broken parameters, e.g. a negative gamma, give infinity or NaN
+		for v := 0; v < 256; v++ {
+			if !finite(curve(float64(v) / 255)) {
+				return p, ErrUnsupportedProfile
+			}
+		}
+		p.curves[i] = curve
+	}
+
+	return p, nil
+}
+
+func parseToneCurve(tag []byte) (toneCurve, error) {
+	if len(tag) < 12 {
+		return nil, ErrUnsupportedProfile
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(v float64) float64 { return v }, nil
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		case n > 1 && len(tag) >= 12+n*2:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+			}
+			return func(v float64) float64 {
+				pos := v * float64(n-1)
+				i := int(pos)
+				if i >= n-1 {
+					return table[n-1]
+				}
+				return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+			}, nil
+		}
+	case "para":
+		return parseParametricCurve(tag)
+	}
+	return nil, ErrUnsupportedProfile
+}
+
+func parseParametricCurve(tag []byte) (toneCurve, error) {
+	paramsCount := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+	function := binary.BigEndian.Uint16(tag[8:])
+	n, ok := paramsCount[function]
+	if !ok || len(tag) < 12+n*4 {
+		return nil, ErrUnsupportedProfile
+	}
+	// g, a, b, c, d, e, f
+	var prm [7]float64
+	prm[1] = 1
+	for i := 0; i < n; i++ {
+		prm[i] = s15Fixed16(tag[12+i*4:])
+	}
+	g, a, b, c, d, e, f := prm[0], prm[1], prm[2], prm[3], prm[4], prm[5], prm[6]
+
+	switch function {
+	case 0:
+		return func(v float64) float64 { return math.Pow(v, g) }, nil
+	case 1:
+		return func(v float64) float64 {
+			if v >= -b/a {
+				return math.Pow(a*v+b, g)
+			}
+			return 0
+		}, nil
+	case 2:
+		return func(v float64) float64 {
+			if v >= -b/a {
+				return math.Pow(a*v+b, g) + c
+			}
+			return c
+		}, nil
+	case 3:
+		return func(v float64) float64 {
+			if v >= d {
+				return math.Pow(a*v+b, g)
+			}
+			return c * v
+		}, nil
+	default:
+		return func(v float64) float64 {
+			if v >= d {
+				return math.Pow(a*v+b, g) + e
+			}
+			return c*v + f
+		}, nil
+	}
+}
+
+// convertToSRGB converts pixels of the image from the given ICC profile to sRGB in place.
+func convertToSRGB(img *image.NRGBA, icc []byte) error {
+	profile, err := parseMatrixProfile(icc)
+	if err != nil {
+		return err
+	}
+
+	toSRGB := multiplyMatrix(invertMatrix(srgbColorants), profile.colorants)
+
+	var linear [3][256]float64
+	for ch := 0; ch < 3; ch++ {
+		for v := 0; v < 256; v++ {
+			linear[ch][v] = profile.curves[ch](float64(v) / 255)
+		}
+	}
+
+	const encodeSteps = 4096
+	var encode [encodeSteps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(srgbEncode(float64(i)/encodeSteps) * 255))
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		r := linear[0][img.Pix[i]]
+		g := linear[1][img.Pix[i+1]]
+		b := linear[2][img.Pix[i+2]]
+		for ch := 0; ch < 3; ch++ {
+			v := toSRGB[ch][0]*r + toSRGB[ch][1]*g + toSRGB[ch][2]*b
+			// NaN is not clamped by math.Max and math.Min
+			if !(v > 0) {
+				v = 0
+			} else if v > 1 {
+				v = 1
+			}
+			img.Pix[i+ch] = encode[int(math.Round(v*encodeSteps))]
+		}
+	}
+	return nil
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func multiplyMatrix(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func invertMatrix(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+
+	return [3][3]float64{
+		{
+			(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det,
+			(m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det,
+			(m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det,
+		},
+		{
+			(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det,
+			(m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det,
+			(m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det,
+		},
+		{
+			(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det,
+			(m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det,
+			(m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det,
+		},
+	}
+}
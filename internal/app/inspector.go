@@ -0,0 +1,23 @@
+package app
+
+import (
+	"errors"
+	"image"
+	"io"
+
+	"github.com/bardex/minipic/internal/httpserver"
+)
+
+// Inspector reads the format and resolution of images from their headers without decoding.
+type Inspector struct{}
+
+func (Inspector) Inspect(src io.Reader) (httpserver.ImageInfo, error) {
+	cfg, imtype, err := image.DecodeConfig(src)
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return httpserver.ImageInfo{}, ErrUnsupportedFormat
+		}
+		return httpserver.ImageInfo{}, err
+	}
+	return httpserver.ImageInfo{Format: imtype, Width: cfg.Width, Height: cfg.Height}, nil
+}
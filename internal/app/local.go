@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bardex/minipic/internal/httpserver"
+)
+
+// LocalScheme the scheme of the images in the local directory: local:///path/image.jpeg.
+const LocalScheme = "local"
+
+// NewLocalDownloader returns the downloader of the local:///<path> images in the root directory.
+// The files are served like by a static HTTP server with Content-Type and Last-Modified headers,
+// the paths can not leave the root directory, even by symlinks, and the directories are not listed.
+func NewLocalDownloader(root string, opts ...DownloaderOption) SimpleImageDownloader {
+	d := SimpleImageDownloader{
+		allowedHosts: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(&d)
+	}
+	d.client = &http.Client{
+		Transport: http.NewFileTransport(filesOnly{localDir(root)}),
+	}
+	return d
+}
+
+// localDir opens the files of the root directory like http.Dir,
+// but the symlinks are resolved and must not lead out of the root.
+type localDir string
+
+func (d localDir) Open(name string) (http.File, error) {
+	root, err := filepath.EvalSymlinks(string(d))
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(resolved)
+}
+
+// filesOnly hides the directories, so that they are not listed.
+type filesOnly struct {
+	fs http.FileSystem
+}
+
+func (f filesOnly) Open(name string) (http.File, error) {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	return file, nil
+}
+
+// SchemeDownloader routes the downloads to the downloaders by the scheme of the image URL.
+type SchemeDownloader map[string]httpserver.Downloader
+
+func (d SchemeDownloader) Download(ctx context.Context, rawURL string, headers http.Header) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	downloader, ok := d[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image URL scheme: %s", u.Scheme)
+	}
+	return downloader.Download(ctx, rawURL, headers)
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// MetadataStrip drop EXIF and XMP metadata (default).
+	MetadataStrip = "strip"
+	// MetadataKeep copy EXIF and XMP metadata into the resized image.
+	MetadataKeep = "keep"
+
+	// ProfileStrip drop the embedded ICC profile (default).
+	ProfileStrip = "strip"
+	// ProfileKeep copy the embedded ICC profile into the resized image.
+	ProfileKeep = "keep"
+	// ProfileSRGB convert pixels from the embedded ICC profile to sRGB.
+	ProfileSRGB = "srgb"
+)
+
+const (
+	jpegSOI  = 0xd8
+	jpegSOS  = 0xda
+	jpegEOI  = 0xd9
+	jpegAPP1 = 0xe1
+	jpegAPP2 = 0xe2
+
+	// maximum payload of a JPEG segment (65535 minus the length field).
+	jpegMaxSegment = 65533
+	// maximum ICC chunk size: segment payload minus "ICC_PROFILE\0", sequence number and count.
+	jpegMaxICCChunk = jpegMaxSegment - 14
+	// maxICCSize the larger profiles are dropped, real profiles take at most a few hundred kilobytes.
+	maxICCSize = 4 << 20
+
+	pngSignature = "\x89PNG\r\n\x1a\n"
+	pngXMPKey    = "XML:com.adobe.xmp"
+)
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// imageMetadata metadata of the source image which is lost while decoding.
+type imageMetadata struct {
+	// icc ICC color profile.
+	icc []byte
+	// exif TIFF-structured EXIF data without any container header.
+	exif []byte
+	// xmp XMP packet.
+	xmp []byte
+}
+
+// extractMetadata reads metadata of JPEG or PNG image, malformed metadata is ignored.
+// The ICC profile is read only if withICC is set, the compressed PNG profile is not inflated needlessly.
+func extractMetadata(data []byte, imtype string, withICC bool) imageMetadata {
+	switch imtype {
+	case "jpeg":
+		return extractJPEGMetadata(data, withICC)
+	case "png":
+		return extractPNGMetadata(data, withICC)
+	}
+	return imageMetadata{}
+}
+
+func extractJPEGMetadata(data []byte, withICC bool) imageMetadata {
+	var meta imageMetadata
+	var iccChunks [][]byte
+
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegSOI {
+		return meta
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// fill byte
+			pos++
+			continue
+		}
+		if marker == jpegSOS || marker == jpegEOI {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		payload := data[pos+4 : pos+2+length]
+		pos += 2 + length
+
+		switch {
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, jpegExifHeader):
+			meta.exif = payload[len(jpegExifHeader):]
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, jpegXMPHeader):
+			meta.xmp = payload[len(jpegXMPHeader):]
+		case withICC && marker == jpegAPP2 && bytes.HasPrefix(payload, jpegICCHeader) && len(payload) > len(jpegICCHeader)+2:
+			seq := int(payload[len(jpegICCHeader)])
+			count := int(payload[len(jpegICCHeader)+1])
+			if seq < 1 || seq > count {
+				continue
+			}
+			if iccChunks == nil {
+				iccChunks = make([][]byte, count)
+			}
+			if count == len(iccChunks) {
+				iccChunks[seq-1] = payload[len(jpegICCHeader)+2:]
+			}
+		}
+	}
+
+	if iccChunks != nil {
+		var icc []byte
+		for _, chunk := range iccChunks {
+			if chunk == nil {
+				// incomplete profile is useless
+				return meta
+			}
+			icc = append(icc, chunk...)
+		}
+		if len(icc) <= maxICCSize {
+			meta.icc = icc
+		}
+	}
+	return meta
+}
+
+func extractPNGMetadata(data []byte, withICC bool) imageMetadata {
+	var meta imageMetadata
+
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return meta
+	}
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			break
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		payload := data[pos+8 : pos+8+length]
+		pos += 12 + length
+
+		switch chunkType {
+		case "iCCP":
+			if !withICC {
+				continue
+			}
+			// profile name, null separator, compression method, compressed profile
+			nul := bytes.IndexByte(payload, 0)
+			if nul < 0 || nul+2 > len(payload) {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(payload[nul+2:]))
+			if err != nil {
+				continue
+			}
+			// the profile is a zlib stream, so a small chunk may inflate to gigabytes
+			icc, err := io.ReadAll(io.LimitReader(zr, maxICCSize+1))
+			if err == nil && len(icc) <= maxICCSize {
+				meta.icc = icc
+			}
+		case "eXIf":
+			meta.exif = payload
+		case "iTXt":
+			// keyword, null, compression flag, compression method, language, null, translated keyword, null, text
+			if !bytes.HasPrefix(payload, []byte(pngXMPKey+"\x00\x00\x00")) {
+				continue
+			}
+			rest := payload[len(pngXMPKey)+3:]
+			for i := 0; i < 2; i++ {
+				nul := bytes.IndexByte(rest, 0)
+				if nul < 0 {
+					rest = nil
+					break
+				}
+				rest = rest[nul+1:]
+			}
+			if rest != nil {
+				meta.xmp = rest
+			}
+		case "IDAT", "IEND":
+			return meta
+		}
+	}
+	return meta
+}
+
+// injectMetadata writes metadata into the encoded image produced by the standard encoders.
+func injectMetadata(img []byte, imtype string, meta imageMetadata) []byte {
+	if meta.icc == nil && meta.exif == nil && meta.xmp == nil {
+		return img
+	}
+	switch imtype {
+	case "jpeg":
+		return injectJPEGMetadata(img, meta)
+	case "png":
+		return injectPNGMetadata(img, meta)
+	}
+	return img
+}
+
+func injectJPEGMetadata(img []byte, meta imageMetadata) []byte {
+	var segments bytes.Buffer
+
+	if meta.exif != nil && len(jpegExifHeader)+len(meta.exif) <= jpegMaxSegment {
+		writeJPEGSegment(&segments, jpegAPP1, jpegExifHeader, meta.exif)
+	}
+	if meta.xmp != nil && len(jpegXMPHeader)+len(meta.xmp) <= jpegMaxSegment {
+		writeJPEGSegment(&segments, jpegAPP1, jpegXMPHeader, meta.xmp)
+	}
+	if meta.icc != nil {
+		count := (len(meta.icc) + jpegMaxICCChunk - 1) / jpegMaxICCChunk
+		if count <= 255 {
+			for i := 0; i < count; i++ {
+				end := (i + 1) * jpegMaxICCChunk
+				if end > len(meta.icc) {
+					end = len(meta.icc)
+				}
+				header := append(append([]byte{}, jpegICCHeader...), byte(i+1), byte(count))
+				writeJPEGSegment(&segments, jpegAPP2, header, meta.icc[i*jpegMaxICCChunk:end])
+			}
+		}
+	}
+
+	// segments are placed right after SOI
+	out := make([]byte, 0, len(img)+segments.Len())
+	out = append(out, img[:2]...)
+	out = append(out, segments.Bytes()...)
+	return append(out, img[2:]...)
+}
+
+func writeJPEGSegment(w *bytes.Buffer, marker byte, header, payload []byte) {
+	w.Write([]byte{0xff, marker})
+	binary.Write(w, binary.BigEndian, uint16(2+len(header)+len(payload)))
+	w.Write(header)
+	w.Write(payload)
+}
+
+func injectPNGMetadata(img []byte, meta imageMetadata) []byte {
+	var chunks bytes.Buffer
+
+	if meta.icc != nil {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(meta.icc)
+		zw.Close()
+		writePNGChunk(&chunks, "iCCP", append([]byte("ICC profile\x00\x00"), compressed.Bytes()...))
+	}
+	if meta.exif != nil {
+		writePNGChunk(&chunks, "eXIf", meta.exif)
+	}
+	if meta.xmp != nil {
+		writePNGChunk(&chunks, "iTXt", append([]byte(pngXMPKey+"\x00\x00\x00\x00\x00"), meta.xmp...))
+	}
+
+	// chunks are placed right after IHDR
+	ihdrEnd := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(img[len(pngSignature):]))
+	out := make([]byte, 0, len(img)+chunks.Len())
+	out = append(out, img[:ihdrEnd]...)
+	out = append(out, chunks.Bytes()...)
+	return append(out, img[ihdrEnd:]...)
+}
+
+func writePNGChunk(w *bytes.Buffer, chunkType string, payload []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(payload)
+	w.WriteString(chunkType)
+	w.Write(payload)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/bardex/minipic/internal/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+// displayP3 D50-adapted XYZ coordinates of the Display P3 primaries (columns are red, green, blue).
+var displayP3 = [3][3]float64{
+	{0.5151, 0.2919, 0.1571},
+	{0.2412, 0.6922, 0.0666},
+	{-0.0011, 0.0419, 0.7841},
+}
+
+// buildMatrixProfile builds a minimal RGB matrix/TRC ICC profile with the gamma tone curves.
+func buildMatrixProfile(colorants [3][3]float64, gamma float64) []byte {
+	var curve bytes.Buffer
+	curve.WriteString("curv\x00\x00\x00\x00")
+	binary.Write(&curve, binary.BigEndian, uint32(1))
+	binary.Write(&curve, binary.BigEndian, uint16(gamma*256))
+	curve.Write([]byte{0, 0})
+	return buildProfile(colorants, curve.Bytes())
+}
+
+// buildProfile builds a minimal RGB matrix/TRC ICC profile with the same tone curve tag of every channel.
+func buildProfile(colorants [3][3]float64, curve []byte) []byte {
+	var tagData bytes.Buffer
+	type tag struct {
+		name   string
+		offset int
+		size   int
+	}
+	var tags []tag
+	dataOffset := 132 + 6*12
+
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		offset := dataOffset + tagData.Len()
+		tagData.WriteString("XYZ \x00\x00\x00\x00")
+		for j := 0; j < 3; j++ {
+			binary.Write(&tagData, binary.BigEndian, int32(colorants[j][i]*65536))
+		}
+		tags = append(tags, tag{name: name, offset: offset, size: 20})
+	}
+	curveOffset := dataOffset + tagData.Len()
+	tagData.Write(curve)
+	for _, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, tag{name: name, offset: curveOffset, size: len(curve)})
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header, uint32(dataOffset+tagData.Len()))
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+
+	var icc bytes.Buffer
+	icc.Write(header)
+	binary.Write(&icc, binary.BigEndian, uint32(len(tags)))
+	for _, t := range tags {
+		icc.WriteString(t.name)
+		binary.Write(&icc, binary.BigEndian, uint32(t.offset))
+		binary.Write(&icc, binary.BigEndian, uint32(t.size))
+	}
+	icc.Write(tagData.Bytes())
+	return icc.Bytes()
+}
+
+func newTestImage(imtype string, c color.Color, meta imageMetadata) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 80))
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 100; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if imtype == "jpeg" {
+		jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100})
+	} else {
+		png.Encode(&buf, img)
+	}
+	return injectMetadata(buf.Bytes(), imtype, meta)
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	meta := imageMetadata{
+		// large profile must be split into several JPEG segments
+		icc:  append(buildMatrixProfile(displayP3, 2.2), bytes.Repeat([]byte{7}, 100000)...),
+		exif: []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00"),
+		xmp:  []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><dc:rights>ACME</dc:rights></x:xmpmeta>`),
+	}
+
+	for _, imtype := range []string{"jpeg", "png"} {
+		imtype := imtype
+		t.Run(imtype, func(t *testing.T) {
+			data := newTestImage(imtype, color.NRGBA{R: 200, G: 100, B: 50, A: 255}, meta)
+
+			_, format, err := image.Decode(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, imtype, format)
+
+			require.Equal(t, meta, extractMetadata(data, imtype, true))
+
+			withoutICC := meta
+			withoutICC.icc = nil
+			require.Equal(t, withoutICC, extractMetadata(data, imtype, false))
+		})
+	}
+}
+
+func TestExtractLargeProfile(t *testing.T) {
+	// the compressed profile takes a few kilobytes, but inflates over the limit
+	large := imageMetadata{icc: make([]byte, maxICCSize+1), exif: []byte("II\x2a\x00\x08\x00\x00\x00\x00\x00")}
+	data := newTestImage("png", color.NRGBA{R: 200, G: 100, B: 50, A: 255}, large)
+	require.Less(t, len(data), 100000)
+	require.Equal(t, imageMetadata{exif: large.exif}, extractMetadata(data, "png", true))
+
+	var dst bytes.Buffer
+	resizer := Resizer{ColorProfile: ProfileKeep}
+	opts := httpserver.ResizeOptions{Mode: httpserver.ResizeModeFit, Width: 50, Height: 50}
+	_, err := resizer.Resize(bytes.NewReader(data), &dst, opts)
+	require.NoError(t, err)
+	require.Nil(t, extractMetadata(dst.Bytes(), "png", true).icc)
+}
+
+func TestResizerMetadata(t *testing.T) {
+	icc := buildMatrixProfile(displayP3, 2.2)
+	meta := imageMetadata{icc: icc, exif: []byte("II\x2a\x00\x08\x00\x00\x00\x00\x00")}
+	opts := httpserver.ResizeOptions{Mode: httpserver.ResizeModeFit, Width: 50, Height: 50}
+
+	tests := []struct {
+		name    string
+		resizer Resizer
+		icc     bool
+		exif    bool
+	}{
+		{name: "default", resizer: Resizer{}, icc: false, exif: false},
+		{name: "keep all", resizer: Resizer{ColorProfile: ProfileKeep, Metadata: MetadataKeep}, icc: true, exif: true},
+		{name: "keep profile", resizer: Resizer{ColorProfile: ProfileKeep, Metadata: MetadataStrip}, icc: true, exif: false},
+		{name: "srgb", resizer: Resizer{ColorProfile: ProfileSRGB, Metadata: MetadataKeep}, icc: false, exif: true},
+	}
+
+	for _, imtype := range []string{"jpeg", "png"} {
+		for _, tt := range tests {
+			imtype, tt := imtype, tt
+			t.Run(imtype+" "+tt.name, func(t *testing.T) {
+				src := newTestImage(imtype, color.NRGBA{R: 200, G: 100, B: 100, A: 255}, meta)
+
+				var dst bytes.Buffer
+				_, err := tt.resizer.Resize(bytes.NewReader(src), &dst, opts)
+				require.NoError(t, err)
+
+				result := extractMetadata(dst.Bytes(), imtype, true)
+				require.Equal(t, tt.icc, result.icc != nil)
+				require.Equal(t, tt.exif, result.exif != nil)
+
+				img, _, err := image.Decode(&dst)
+				require.NoError(t, err)
+				r, g, b, _ := img.At(25, 20).RGBA()
+				if tt.resizer.ColorProfile == ProfileSRGB {
+					// Display P3 colors are more saturated than the same sRGB values
+					require.Greater(t, r>>8, uint32(205))
+					require.Less(t, g>>8, uint32(95))
+				} else {
+					require.InDelta(t, 200, r>>8, 3)
+					require.InDelta(t, 100, g>>8, 3)
+					require.InDelta(t, 100, b>>8, 3)
+				}
+			})
+		}
+	}
+}
+
+func TestResizerNonRGBProfile(t *testing.T) {
+	opts := httpserver.ResizeOptions{Mode: httpserver.ResizeModeFit, Width: 50, Height: 50}
+	for _, space := range []string{"CMYK", "GRAY"} {
+		icc := buildMatrixProfile(displayP3, 2.2)
+		copy(icc[16:], space)
+		for _, profile := range []string{ProfileKeep, ProfileSRGB} {
+			src := newTestImage("jpeg", color.NRGBA{R: 200, G: 100, B: 100, A: 255}, imageMetadata{icc: icc})
+			var dst bytes.Buffer
+			_, err := Resizer{ColorProfile: profile}.Resize(bytes.NewReader(src), &dst, opts)
+			require.NoError(t, err)
+			require.Nil(t, extractMetadata(dst.Bytes(), "jpeg", true).icc, space+" "+profile)
+		}
+	}
+}
+
+func TestConvertToSRGB(t *testing.T) {
+	// the sRGB-like profile must keep colors almost unchanged
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.Pix = []uint8{200, 100, 50, 255}
+	require.NoError(t, convertToSRGB(img, buildMatrixProfile(srgbColorants, 2.2)))
+	require.InDelta(t, 200, img.Pix[0], 3)
+	require.InDelta(t, 100, img.Pix[1], 6)
+	require.InDelta(t, 50, img.Pix[2], 6)
+	require.Equal(t, uint8(255), img.Pix[3])
+
+	require.ErrorIs(t, convertToSRGB(img, []byte("not a profile")), ErrUnsupportedProfile)
+
+	// the negative gamma turns black into infinity
+	var curve bytes.Buffer
+	curve.WriteString("para\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.Write(&curve, binary.BigEndian, int32(-2*65536))
+	broken := buildProfile(srgbColorants, curve.Bytes())
+	img.Pix = []uint8{0, 0, 0, 255}
+	require.ErrorIs(t, convertToSRGB(img, broken), ErrUnsupportedProfile)
+	require.Equal(t, []uint8{0, 0, 0, 255}, img.Pix)
+
+	src := newTestImage("png", color.NRGBA{A: 255}, imageMetadata{icc: broken})
+	var dst bytes.Buffer
+	opts := []httpserver.ResizeOptions{{Mode: httpserver.ResizeModeFit, Width: 50, Height: 50}}
+	_, err := Resizer{ColorProfile: ProfileSRGB}.ResizeBatch(bytes.NewReader(src), []io.Writer{&dst}, opts)
+	require.NoError(t, err)
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bardex/minipic/internal/httpserver"
+)
+
+// Origin the configured image origin, the images are requested as @<name>/<path>.
+type Origin struct {
+	// Base the URL prefix of the images, e.g. https://cdn-internal.example/img/.
+	Base string
+	// Headers the headers added to the requests, Host sets the virtual host.
+	Headers map[string]string
+	// Timeout the download timeout, 0 - the timeout of the request.
+	Timeout time.Duration
+	// Auth the credentials of the origin.
+	Auth Credentials
+	// Fallbacks the names of the origins which are tried in order with the same path
+	// when the image is not found, the origin fails or times out.
+	Fallbacks []string
+}
+
+// OriginDownloader downloads the origin://<name>/<path> images from the configured origins.
+type OriginDownloader struct {
+	http    SimpleImageDownloader
+	origins map[string]Origin
+}
+
+// NewOriginDownloader returns the downloader of the images on the origins, the origin hosts are trusted,
+// see newTrustedDownloader.
+func NewOriginDownloader(origins map[string]Origin, opts ...DownloaderOption) OriginDownloader {
+	return OriginDownloader{http: newTrustedDownloader(opts), origins: origins}
+}
+
+func (d OriginDownloader) Download(ctx context.Context, rawURL string, headers http.Header) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	origin, ok := d.origins[u.Host]
+	if u.Scheme != httpserver.OriginScheme || !ok {
+		return nil, fmt.Errorf("unknown origin: %s", u.Host)
+	}
+
+	res, err := d.download(ctx, origin, u, headers)
+	for _, name := range origin.Fallbacks {
+		if ctx.Err() != nil || !unavailable(res, err) {
+			break
+		}
+		fallback, ok := d.origins[name]
+		if !ok {
+			break
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		res, err = d.download(ctx, fallback, u, headers)
+	}
+	return res, err
+}
+
+// download requests the image from the origin.
+func (d OriginDownloader) download(
+	ctx context.Context, origin Origin, u *url.URL, headers http.Header,
+) (*http.Response, error) {
+	imageURL, err := origin.imageURL(u.Path, u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	cancel := func() {}
+	if origin.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, origin.Timeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header = clientHeaders(headers)
+	static := make(http.Header, len(origin.Headers))
+	for k, v := range origin.Headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		static.Set(k, v)
+	}
+	for k, v := range origin.Auth.header() {
+		static[k] = v
+	}
+
+	res, err := d.http.do(req, static)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the timeout covers reading of the body
+	res.Body = cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// unavailable reports whether the image should be requested from the fallback origin.
+func unavailable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone || res.StatusCode >= 500
+}
+
+// imageURL returns the URL of the image, the path can not leave the base.
+func (o Origin) imageURL(imagePath, query string) (string, error) {
+	base, err := url.Parse(o.Base)
+	if err != nil {
+		return "", errors.New("invalid origin base URL")
+	}
+	if base.Host == "" {
+		return "", fmt.Errorf("invalid origin base URL: %s", base.Redacted())
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+imagePath), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("image path must not be empty")
+	}
+	u := strings.TrimRight(o.Base, "/") + "/" + (&url.URL{Path: cleaned}).EscapedPath()
+	if query != "" {
+		u += "?" + query
+	}
+	return u, nil
+}
+
+// cancelBody cancels the context of the request when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,510 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// Progressive JPEG encoder: the standard library supports only baseline JPEG.
+// Coefficients are split into several scans by spectral selection, so browsers
+// can render a blurry preview of the image while the rest is still loading.
+
+const (
+	jpegSOF2 = 0xc2
+	jpegDQT  = 0xdb
+	jpegDHT  = 0xc4
+)
+
+// jpegZigzag maps the zig-zag ordering to the natural ordering.
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegUnscaledQuant quantization tables from the section K.1 of the spec in zig-zag order.
+var jpegUnscaledQuant = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegHuffmanSpec Huffman table from the section K.3 of the spec.
+type jpegHuffmanSpec struct {
+	// class and destination identifier of the table as written in DHT
+	id byte
+	// count[i] is the number of codes of length i+1 bits
+	count [16]byte
+	value []byte
+}
+
+// jpegHuffmanSpecs luminance DC, luminance AC, chrominance DC, chrominance AC.
+var jpegHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		id:    0x00,
+		count: [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		value: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		id:    0x10,
+		count: [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		value: []byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		id:    0x01,
+		count: [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		value: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		id:    0x11,
+		count: [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		value: []byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegHuffmanCodes compiled jpegHuffmanSpecs: value -> codeword size in the 8 high bits and codeword.
+var jpegHuffmanCodes [4][256]uint32
+
+// jpegDCTCos cosine table of the 8-point DCT.
+var jpegDCTCos [8][8]float64
+
+func init() {
+	for i, spec := range jpegHuffmanSpecs {
+		code, k := uint32(0), 0
+		for size := 0; size < 16; size++ {
+			for j := byte(0); j < spec.count[size]; j++ {
+				jpegHuffmanCodes[i][spec.value[k]] = uint32(size+1)<<24 | code
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c := math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+			if u == 0 {
+				c *= math.Sqrt2 / 2
+			}
+			jpegDCTCos[x][u] = c / 2
+		}
+	}
+}
+
+// jpegScan single scan of the progressive image.
+type jpegScan struct {
+	components []int
+	// spectral selection start and end
+	ss, se int
+}
+
+// jpegProgressiveScans DC of all components, then low and high frequencies of luma with chroma in between.
+var jpegProgressiveScans = []jpegScan{
+	{components: []int{0, 1, 2}, ss: 0, se: 0},
+	{components: []int{0}, ss: 1, se: 5},
+	{components: []int{1}, ss: 1, se: 63},
+	{components: []int{2}, ss: 1, se: 63},
+	{components: []int{0}, ss: 6, se: 63},
+}
+
+// jpegComponent quantized DCT coefficients of a single color component.
+type jpegComponent struct {
+	// table index of the quantization and Huffman tables: 0 - luminance, 1 - chrominance
+	table int
+	// sampling factor
+	sampling int
+	// blocks of all MCUs, row by row
+	blocksW, blocksH int
+	// blocks of the visible area, only they are coded in non-interleaved scans
+	visibleW, visibleH int
+	// coefficients in zig-zag order
+	blocks [][64]int32
+}
+
+type progressiveEncoder struct {
+	w     *bufio.Writer
+	err   error
+	bits  uint32
+	nBits uint32
+	quant [2][64]int
+}
+
+// encodeProgressiveJPEG writes the image in JPEG 4:2:0 progressive format.
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New("jpeg: image is too large to encode")
+	}
+
+	e := progressiveEncoder{w: bufio.NewWriter(w)}
+	e.initQuant(quality)
+	components := e.transform(img)
+
+	e.write([]byte{0xff, jpegSOI})
+	e.writeDQT()
+	e.writeSOF2(b.Dx(), b.Dy())
+	e.writeDHT()
+	for _, scan := range jpegProgressiveScans {
+		e.writeScan(scan, components)
+	}
+	e.write([]byte{0xff, jpegEOI})
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+func (e *progressiveEncoder) initQuant(quality int) {
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i := range e.quant {
+		for j := range e.quant[i] {
+			q := (jpegUnscaledQuant[i][j]*scale + 50) / 100
+			if q < 1 {
+				q = 1
+			} else if q > 255 {
+				q = 255
+			}
+			e.quant[i][j] = q
+		}
+	}
+}
+
+// transform converts the image to YCbCr 4:2:0 and calculates quantized DCT coefficients.
+func (e *progressiveEncoder) transform(img image.Image) []*jpegComponent {
+	b := img.Bounds()
+	mcuW := (b.Dx() + 15) / 16
+	mcuH := (b.Dy() + 15) / 16
+	planeW, planeH := mcuW*16, mcuH*16
+
+	// full resolution planes, the edge pixels are replicated into the padding
+	planes := [3][]float64{
+		make([]float64, planeW*planeH),
+		make([]float64, planeW*planeH),
+		make([]float64, planeW*planeH),
+	}
+	for y := 0; y < planeH; y++ {
+		sy := b.Min.Y + minInt(y, b.Dy()-1)
+		for x := 0; x < planeW; x++ {
+			sx := b.Min.X + minInt(x, b.Dx()-1)
+			r, g, bl := pixelRGB(img, sx, sy)
+			yy, cb, cr := color.RGBToYCbCr(r, g, bl)
+			planes[0][y*planeW+x] = float64(yy)
+			planes[1][y*planeW+x] = float64(cb)
+			planes[2][y*planeW+x] = float64(cr)
+		}
+	}
+
+	luma := &jpegComponent{
+		table:    0,
+		sampling: 2,
+		blocksW:  mcuW * 2,
+		blocksH:  mcuH * 2,
+		visibleW: (b.Dx() + 7) / 8,
+		visibleH: (b.Dy() + 7) / 8,
+	}
+	e.quantizePlane(luma, planes[0], planeW)
+
+	components := []*jpegComponent{luma}
+	chromaW, chromaH := planeW/2, planeH/2
+	for _, plane := range planes[1:] {
+		// 2x2 box downsampling
+		sub := make([]float64, chromaW*chromaH)
+		for y := 0; y < chromaH; y++ {
+			for x := 0; x < chromaW; x++ {
+				i := 2*y*planeW + 2*x
+				sub[y*chromaW+x] = (plane[i] + plane[i+1] + plane[i+planeW] + plane[i+planeW+1]) / 4
+			}
+		}
+		chroma := &jpegComponent{
+			table:    1,
+			sampling: 1,
+			blocksW:  mcuW,
+			blocksH:  mcuH,
+			visibleW: ((b.Dx()+1)/2 + 7) / 8,
+			visibleH: ((b.Dy()+1)/2 + 7) / 8,
+		}
+		e.quantizePlane(chroma, sub, chromaW)
+		components = append(components, chroma)
+	}
+	return components
+}
+
+func (e *progressiveEncoder) quantizePlane(c *jpegComponent, plane []float64, stride int) {
+	c.blocks = make([][64]int32, c.blocksW*c.blocksH)
+	var pixels, rows [64]float64
+	for by := 0; by < c.blocksH; by++ {
+		for bx := 0; bx < c.blocksW; bx++ {
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					pixels[y*8+x] = plane[(by*8+y)*stride+bx*8+x] - 128
+				}
+			}
+			// separable 2D DCT-II
+			for y := 0; y < 8; y++ {
+				for u := 0; u < 8; u++ {
+					var sum float64
+					for x := 0; x < 8; x++ {
+						sum += pixels[y*8+x] * jpegDCTCos[x][u]
+					}
+					rows[y*8+u] = sum
+				}
+			}
+			block := &c.blocks[by*c.blocksW+bx]
+			for zig := 0; zig < 64; zig++ {
+				n := jpegZigzag[zig]
+				u, v := n%8, n/8
+				var sum float64
+				for y := 0; y < 8; y++ {
+					sum += rows[y*8+u] * jpegDCTCos[y][v]
+				}
+				block[zig] = int32(math.Round(sum / float64(e.quant[c.table][zig])))
+			}
+		}
+	}
+}
+
+func (e *progressiveEncoder) writeScan(scan jpegScan, components []*jpegComponent) {
+	// SOS header
+	e.write([]byte{0xff, jpegSOS, 0, byte(6 + 2*len(scan.components)), byte(len(scan.components))})
+	for _, ci := range scan.components {
+		table := byte(components[ci].table)
+		e.write([]byte{byte(ci + 1), table<<4 | table})
+	}
+	e.write([]byte{byte(scan.ss), byte(scan.se), 0})
+
+	if scan.ss == 0 {
+		// interleaved DC scan over all MCUs
+		prevDC := make([]int32, len(components))
+		luma := components[0]
+		for my := 0; my < luma.blocksH/luma.sampling; my++ {
+			for mx := 0; mx < luma.blocksW/luma.sampling; mx++ {
+				for _, ci := range scan.components {
+					c := components[ci]
+					for y := 0; y < c.sampling; y++ {
+						for x := 0; x < c.sampling; x++ {
+							block := &c.blocks[(my*c.sampling+y)*c.blocksW+mx*c.sampling+x]
+							e.emitValue(2*c.table, 0, block[0]-prevDC[ci])
+							prevDC[ci] = block[0]
+						}
+					}
+				}
+			}
+		}
+	} else {
+		// non-interleaved AC scan over the visible blocks of one component
+		c := components[scan.components[0]]
+		for by := 0; by < c.visibleH; by++ {
+			for bx := 0; bx < c.visibleW; bx++ {
+				e.writeACBand(&c.blocks[by*c.blocksW+bx], 2*c.table+1, scan.ss, scan.se)
+			}
+		}
+	}
+
+	// pad the last byte with 1's
+	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+func (e *progressiveEncoder) writeACBand(block *[64]int32, table, ss, se int) {
+	run := int32(0)
+	for k := ss; k <= se; k++ {
+		if block[k] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			e.emitHuff(table, 0xf0)
+			run -= 16
+		}
+		e.emitValue(table, run, block[k])
+		run = 0
+	}
+	if run > 0 {
+		// EOB0: end of band in this block only
+		e.emitHuff(table, 0x00)
+	}
+}
+
+// emitValue emits the Huffman coded run/size symbol followed by the value bits.
+func (e *progressiveEncoder) emitValue(table int, run, value int32) {
+	a, b := value, value
+	if a < 0 {
+		a, b = -value, value-1
+	}
+	var size uint32
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+	e.emitHuff(table, run<<4|int32(size))
+	if size > 0 {
+		e.emit(uint32(b)&(1<<size-1), size)
+	}
+}
+
+func (e *progressiveEncoder) emitHuff(table int, value int32) {
+	code := jpegHuffmanCodes[table][value]
+	e.emit(code&(1<<24-1), code>>24)
+}
+
+// emit emits the least significant nBits bits of bits to the bit-stream.
+func (e *progressiveEncoder) emit(bits, nBits uint32) {
+	nBits += e.nBits
+	bits <<= 32 - nBits
+	bits |= e.bits
+	for nBits >= 8 {
+		b := uint8(bits >> 24)
+		e.writeByte(b)
+		if b == 0xff {
+			e.writeByte(0x00)
+		}
+		bits <<= 8
+		nBits -= 8
+	}
+	e.bits, e.nBits = bits, nBits
+}
+
+func (e *progressiveEncoder) writeDQT() {
+	e.writeMarkerHeader(jpegDQT, 2+2*65)
+	for i := range e.quant {
+		e.writeByte(byte(i))
+		for _, q := range e.quant[i] {
+			e.writeByte(byte(q))
+		}
+	}
+}
+
+func (e *progressiveEncoder) writeSOF2(width, height int) {
+	e.writeMarkerHeader(jpegSOF2, 8+3*3)
+	e.write([]byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3})
+	// 4:2:0 chroma subsampling
+	e.write([]byte{1, 0x22, 0, 2, 0x11, 1, 3, 0x11, 1})
+}
+
+func (e *progressiveEncoder) writeDHT() {
+	length := 2
+	for _, spec := range jpegHuffmanSpecs {
+		length += 1 + 16 + len(spec.value)
+	}
+	e.writeMarkerHeader(jpegDHT, length)
+	for _, spec := range jpegHuffmanSpecs {
+		e.writeByte(spec.id)
+		e.write(spec.count[:])
+		e.write(spec.value)
+	}
+}
+
+func (e *progressiveEncoder) writeMarkerHeader(marker byte, length int) {
+	e.write([]byte{0xff, marker, byte(length >> 8), byte(length)})
+}
+
+func (e *progressiveEncoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(p)
+}
+
+func (e *progressiveEncoder) writeByte(b byte) {
+	if e.err != nil {
+		return
+	}
+	e.err = e.w.WriteByte(b)
+}
+
+// pixelRGB returns the alpha-premultiplied color of the pixel, with a fast path for NRGBA images.
+func pixelRGB(img image.Image, x, y int) (r, g, b uint8) {
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		pix := nrgba.Pix[nrgba.PixOffset(x, y):]
+		a := uint32(pix[3])
+		return uint8(uint32(pix[0]) * a / 0xff), uint8(uint32(pix[1]) * a / 0xff), uint8(uint32(pix[2]) * a / 0xff)
+	}
+	cr, cg, cb, _ := img.At(x, y).RGBA()
+	return uint8(cr >> 8), uint8(cg >> 8), uint8(cb >> 8)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
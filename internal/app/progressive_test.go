@@ -0,0 +1,94 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeProgressiveJPEG(t *testing.T) {
+	sizes := []image.Point{{1, 1}, {7, 5}, {8, 8}, {9, 17}, {16, 16}, {33, 1}, {1, 40}, {250, 199}}
+	for _, size := range sizes {
+		img := testPattern(size.X, size.Y)
+		for _, quality := range []int{1, 5, 50, 90, 100} {
+			size, quality := size, quality
+			t.Run(fmt.Sprintf("%dx%d q%d", size.X, size.Y, quality), func(t *testing.T) {
+				var progressive, baseline bytes.Buffer
+				require.NoError(t, encodeProgressiveJPEG(&progressive, img, quality))
+				require.NoError(t, jpeg.Encode(&baseline, img, &jpeg.Options{Quality: quality}))
+
+				// the frame is progressive DCT (SOF2), not baseline (SOF0)
+				data := progressive.Bytes()
+				markers := headerMarkers(t, data)
+				require.Contains(t, markers, byte(0xc2))
+				require.NotContains(t, markers, byte(0xc0))
+
+				decoded, err := jpeg.Decode(bytes.NewReader(data))
+				require.NoError(t, err)
+				require.Equal(t, img.Bounds(), decoded.Bounds())
+				expected, err := jpeg.Decode(&baseline)
+				require.NoError(t, err)
+
+				// the picture is as close to the source as the baseline one with the same quality
+				require.LessOrEqual(t, meanDifference(img, decoded), meanDifference(img, expected)+1)
+			})
+		}
+	}
+}
+
+// headerMarkers returns the markers of the segments before the first scan.
+func headerMarkers(t *testing.T, data []byte) []byte {
+	require.Equal(t, []byte{0xff, jpegSOI}, data[:2])
+	var markers []byte
+	for i := 2; ; {
+		require.Less(t, i+4, len(data))
+		require.Equal(t, byte(0xff), data[i])
+		marker := data[i+1]
+		markers = append(markers, marker)
+		if marker == 0xda {
+			return markers
+		}
+		i += 2 + int(data[i+2])<<8 + int(data[i+3])
+	}
+}
+
+// testPattern returns the image with the gradients and the sharp edges.
+func testPattern(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255}
+			if (x/5+y/5)%2 == 0 {
+				c.B = 255 - c.R
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// meanDifference returns the mean absolute difference of the 8-bit color channels of the images.
+func meanDifference(a, b image.Image) float64 {
+	var sum, n float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range [][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}} {
+				diff := float64(d[0]>>8) - float64(d[1]>>8)
+				if diff < 0 {
+					diff = -diff
+				}
+				sum += diff
+				n++
+			}
+		}
+	}
+	return sum / n
+}
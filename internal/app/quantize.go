@@ -0,0 +1,119 @@
+package app
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// colorBox set of histogram colors which becomes a single palette entry.
+type colorBox struct {
+	colors []histogramColor
+	count  int
+}
+
+type histogramColor struct {
+	rgba  [4]uint8
+	count int
+}
+
+// quantize reduces the image to the palette of the given number of colors
+// using the median cut algorithm and Floyd-Steinberg dithering.
+func quantize(img image.Image, colors int) *image.Paletted {
+	src := imaging.Clone(img)
+
+	histogram := make(map[[4]uint8]int)
+	for i := 0; i < len(src.Pix); i += 4 {
+		histogram[[4]uint8{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}]++
+	}
+
+	box := colorBox{colors: make([]histogramColor, 0, len(histogram))}
+	for c, count := range histogram {
+		box.colors = append(box.colors, histogramColor{rgba: c, count: count})
+		box.count += count
+	}
+
+	boxes := []colorBox{box}
+	for len(boxes) < colors {
+		// split the most populated box which still has different colors
+		split := -1
+		for i, b := range boxes {
+			if len(b.colors) > 1 && (split < 0 || b.count > boxes[split].count) {
+				split = i
+			}
+		}
+		if split < 0 {
+			break
+		}
+		a, b := boxes[split].split()
+		boxes[split] = a
+		boxes = append(boxes, b)
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, b := range boxes {
+		palette = append(palette, b.average())
+	}
+
+	dst := image.NewPaletted(src.Bounds(), palette)
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), src, src.Bounds().Min)
+	return dst
+}
+
+// split divides the box at the weighted median of its widest channel.
+func (b colorBox) split() (colorBox, colorBox) {
+	channel, widest := 0, -1
+	for ch := 0; ch < 4; ch++ {
+		lo, hi := uint8(255), uint8(0)
+		for _, c := range b.colors {
+			if c.rgba[ch] < lo {
+				lo = c.rgba[ch]
+			}
+			if c.rgba[ch] > hi {
+				hi = c.rgba[ch]
+			}
+		}
+		if int(hi)-int(lo) > widest {
+			channel, widest = ch, int(hi)-int(lo)
+		}
+	}
+
+	sort.Slice(b.colors, func(i, j int) bool {
+		return b.colors[i].rgba[channel] < b.colors[j].rgba[channel]
+	})
+
+	median, count := len(b.colors)-1, 0
+	for i, c := range b.colors[:len(b.colors)-1] {
+		count += c.count
+		if count*2 >= b.count {
+			median = i + 1
+			break
+		}
+	}
+
+	first := colorBox{colors: b.colors[:median]}
+	second := colorBox{colors: b.colors[median:]}
+	for _, c := range first.colors {
+		first.count += c.count
+	}
+	second.count = b.count - first.count
+	return first, second
+}
+
+func (b colorBox) average() color.NRGBA {
+	var sum [4]int
+	for _, c := range b.colors {
+		for ch := 0; ch < 4; ch++ {
+			sum[ch] += int(c.rgba[ch]) * c.count
+		}
+	}
+	return color.NRGBA{
+		R: uint8(sum[0] / b.count),
+		G: uint8(sum[1] / b.count),
+		B: uint8(sum[2] / b.count),
+		A: uint8(sum[3] / b.count),
+	}
+}
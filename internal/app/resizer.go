@@ -1,6 +1,7 @@
 package app
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
@@ -10,6 +11,7 @@ import (
 	"image/png"
 	"io"
 	"math"
+	"sync"
 
 	"github.com/bardex/minipic/internal/httpserver"
 	"github.com/disintegration/imaging"
@@ -22,17 +24,90 @@ var (
 	ErrUnsupportedMode = errors.New("unsupported resize mode")
 )
 
-type Resizer struct{}
+const (
+	defaultJPEGQuality = 85
+	minJPEGQuality     = 5
+	// maxBytesAttempts limits the number of encodings while searching the quality for the max_bytes option.
+	maxBytesAttempts = 7
+)
+
+type Resizer struct {
+	// ColorProfile what to do with the embedded ICC profile: ProfileStrip (default), ProfileKeep or ProfileSRGB.
+	ColorProfile string
+	// Metadata what to do with EXIF and XMP metadata: MetadataStrip (default) or MetadataKeep.
+	Metadata string
+	// MaxSourcePixels maximum resolution (width*height) of the source image, 0 - no limit.
+	MaxSourcePixels int
+	// MaxOutputPixels maximum resolution (width*height) of the resized image, 0 - no limit.
+	MaxOutputPixels int
+}
 
-func (r Resizer) Resize(src io.Reader, dst io.Writer, opts httpserver.ResizeOptions) error {
-	img, imtype, err := image.Decode(src)
+func (r Resizer) Resize(src io.Reader, dst io.Writer, opts httpserver.ResizeOptions) (httpserver.ResizeResult, error) {
+	data, err := io.ReadAll(src)
 	if err != nil {
-		if errors.Is(err, image.ErrFormat) {
-			return ErrUnsupportedFormat
+		return httpserver.ResizeResult{}, err
+	}
+
+	img, imtype, err := decode(data, r.MaxSourcePixels)
+	if err != nil {
+		return httpserver.ResizeResult{}, err
+	}
+
+	out, result, err := r.render(img, imtype, r.metadata(data, imtype), opts)
+	if err != nil {
+		return httpserver.ResizeResult{}, err
+	}
+	if _, err = dst.Write(out); err != nil {
+		return httpserver.ResizeResult{}, err
+	}
+	return result, nil
+}
+
+// ResizeBatch decodes the source image once and renders every size in parallel,
+// the result of opts[i] is written to dsts[i].
+func (r Resizer) ResizeBatch(
+	src io.Reader, dsts []io.Writer, opts []httpserver.ResizeOptions,
+) ([]httpserver.ResizeResult, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	img, imtype, err := decode(data, r.MaxSourcePixels)
+	if err != nil {
+		return nil, err
+	}
+	meta := r.metadata(data, imtype)
+
+	results := make([]httpserver.ResizeResult, len(opts))
+	outs := make([][]byte, len(opts))
+	errs := make([]error, len(opts))
+	var wg sync.WaitGroup
+	for i := range opts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			outs[i], results[i], errs[i] = r.render(img, imtype, meta, opts[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, out := range outs {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if _, err = dsts[i].Write(out); err != nil {
+			return nil, err
 		}
-		return err
 	}
+	return results, nil
+}
 
+// render resizes and encodes the decoded image, img is not modified.
+func (r Resizer) render(
+	img image.Image, imtype string, meta imageMetadata, opts httpserver.ResizeOptions,
+) ([]byte, httpserver.ResizeResult, error) {
+	var err error
 	srcWidth := float64(img.Bounds().Dx())
 	srcHeight := float64(img.Bounds().Dy())
 
@@ -41,11 +116,18 @@ func (r Resizer) Resize(src io.Reader, dst io.Writer, opts httpserver.ResizeOpti
 		k := math.Max(srcWidth/float64(opts.Width), srcHeight/float64(opts.Height))
 		width := int(math.Round(srcWidth / k))
 		height := int(math.Round(srcHeight / k))
+		if err = r.checkOutputResolution(width, height); err != nil {
+			return nil, httpserver.ResizeResult{}, err
+		}
 		img = imaging.Resize(img, width, height, imaging.Lanczos)
 	case httpserver.ResizeModeFill:
 		k := math.Min(srcWidth/float64(opts.Width), srcHeight/float64(opts.Height))
 		width := int(math.Round(srcWidth / k))
 		height := int(math.Round(srcHeight / k))
+		// the image is resized before cropping, so the limit applies to the uncropped size
+		if err = r.checkOutputResolution(width, height); err != nil {
+			return nil, httpserver.ResizeResult{}, err
+		}
 		img = imaging.Resize(img, width, height, imaging.Lanczos)
 		if width > opts.Width {
 			padX := (width - opts.Width) / 2
@@ -56,21 +138,147 @@ func (r Resizer) Resize(src io.Reader, dst io.Writer, opts httpserver.ResizeOpti
 			img = imaging.Crop(img, image.Rect(0, padY, width, padY+opts.Height))
 		}
 	default:
-		return fmt.Errorf("%w: %s", ErrUnsupportedMode, opts.Mode)
+		return nil, httpserver.ResizeResult{}, fmt.Errorf("%w: %s", ErrUnsupportedMode, opts.Mode)
+	}
+
+	quality := 0
+	if r.ColorProfile == ProfileSRGB && meta.icc != nil {
+		converted := imaging.Clone(img)
+		// unsupported profiles are kept as is, so that colors are still rendered correctly
+		if err = convertToSRGB(converted, meta.icc); err == nil {
+			img = converted
+			meta.icc = nil
+		}
 	}
 
+	var out []byte
 	switch imtype {
 	case "jpeg":
-		if err = imaging.Encode(dst, img, imaging.JPEG, imaging.JPEGQuality(85)); err != nil {
-			return err
+		if opts.MaxBytes > 0 {
+			out, quality, err = r.encodeJPEGMaxBytes(img, opts, meta)
+		} else {
+			quality = defaultJPEGQuality
+			out, err = r.encodeJPEG(img, quality, opts, meta)
+		}
+		if err != nil {
+			return nil, httpserver.ResizeResult{}, err
 		}
 	case "png":
-		if err = imaging.Encode(dst, img, imaging.PNG, imaging.PNGCompressionLevel(png.BestCompression)); err != nil {
-			return err
+		if opts.Palette > 0 {
+			img = quantize(img, opts.Palette)
+		}
+		var buf bytes.Buffer
+		if err = imaging.Encode(&buf, img, imaging.PNG, imaging.PNGCompressionLevel(png.BestCompression)); err != nil {
+			return nil, httpserver.ResizeResult{}, err
+		}
+		out = injectMetadata(buf.Bytes(), imtype, meta)
+		// PNG is lossless, there is no quality to lower
+		if opts.MaxBytes > 0 && len(out) > opts.MaxBytes {
+			return nil, httpserver.ResizeResult{}, fmt.Errorf("%w: %d", httpserver.ErrMaxBytesUnreachable, opts.MaxBytes)
 		}
 	default:
-		return fmt.Errorf("%w: %s", ErrUnsupportedFormat, imtype)
+		return nil, httpserver.ResizeResult{}, fmt.Errorf("%w: %s", ErrUnsupportedFormat, imtype)
 	}
 
+	return out, httpserver.ResizeResult{Format: imtype, Quality: quality}, nil
+}
+
+func (r Resizer) encodeJPEG(
+	img image.Image, quality int, opts httpserver.ResizeOptions, meta imageMetadata,
+) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if opts.Progressive {
+		err = encodeProgressiveJPEG(&buf, img, quality)
+	} else {
+		err = imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(quality))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return injectMetadata(buf.Bytes(), "jpeg", meta), nil
+}
+
+// encodeJPEGMaxBytes binary-searches the highest quality (up to the default one)
+// at which the encoded image fits into opts.MaxBytes.
+func (r Resizer) encodeJPEGMaxBytes(
+	img image.Image, opts httpserver.ResizeOptions, meta imageMetadata,
+) ([]byte, int, error) {
+	out, err := r.encodeJPEG(img, defaultJPEGQuality, opts, meta)
+	if err != nil || len(out) <= opts.MaxBytes {
+		return out, defaultJPEGQuality, err
+	}
+
+	var best []byte
+	bestQuality := 0
+	lo, hi := minJPEGQuality, defaultJPEGQuality-1
+	for attempt := 0; attempt < maxBytesAttempts && lo <= hi; attempt++ {
+		quality := (lo + hi) / 2
+		out, err = r.encodeJPEG(img, quality, opts, meta)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(out) <= opts.MaxBytes {
+			best, bestQuality = out, quality
+			lo = quality + 1
+		} else {
+			hi = quality - 1
+		}
+	}
+
+	if best == nil {
+		return nil, 0, fmt.Errorf("%w: %d", httpserver.ErrMaxBytesUnreachable, opts.MaxBytes)
+	}
+	return best, bestQuality, nil
+}
+
+// metadata extracts only the metadata which must be copied or used for conversion.
+func (r Resizer) metadata(data []byte, imtype string) imageMetadata {
+	keepICC := r.ColorProfile == ProfileKeep || r.ColorProfile == ProfileSRGB
+	if !keepICC && r.Metadata != MetadataKeep {
+		return imageMetadata{}
+	}
+	meta := extractMetadata(data, imtype, keepICC)
+	// the output is always RGB, the CMYK or gray profile of the source would distort its colors
+	if len(meta.icc) < 20 || string(meta.icc[16:20]) != "RGB " {
+		meta.icc = nil
+	}
+	if r.Metadata != MetadataKeep {
+		meta.exif = nil
+		meta.xmp = nil
+	}
+	return meta
+}
+
+func (r Resizer) checkOutputResolution(width, height int) error {
+	if r.MaxOutputPixels > 0 && width*height > r.MaxOutputPixels {
+		return fmt.Errorf("%w: %dx%d exceeds %d pixels", httpserver.ErrOutputResolution, width, height, r.MaxOutputPixels)
+	}
 	return nil
 }
+
+// decode decodes the image, the resolution is checked before decoding to not allocate memory for decompression bombs.
+func decode(data []byte, maxPixels int) (image.Image, string, error) {
+	if maxPixels > 0 {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			if errors.Is(err, image.ErrFormat) {
+				return nil, "", ErrUnsupportedFormat
+			}
+			return nil, "", err
+		}
+		if cfg.Width*cfg.Height > maxPixels {
+			err = fmt.Errorf("%w: %dx%d exceeds %d pixels", httpserver.ErrSourceResolution, cfg.Width, cfg.Height, maxPixels)
+			return nil, "", err
+		}
+	}
+
+	img, imtype, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return nil, "", ErrUnsupportedFormat
+		}
+		return nil, "", err
+	}
+	return img, imtype, nil
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/bardex/minipic/internal/httpserver"
+)
+
+// maxDrainSize the maximum size of the failed response body read to reuse the connection.
+const maxDrainSize = 64 * 1024
+
+// RetryPolicy retries the downloads failed with the network timeouts, the refused or reset connections
+// or 502, 503, 504 statuses.
+type RetryPolicy struct {
+	// Retries the number of the retries, 0 - a single attempt.
+	Retries int
+	// Delay the delay before the first retry, it doubles with every retry.
+	Delay time.Duration
+	// MaxDelay limits the delay, 0 - no limit.
+	MaxDelay time.Duration
+}
+
+// WithRetry retries the transient download failures with jittered exponential backoff.
+func WithRetry(policy RetryPolicy) DownloaderOption {
+	return func(d *SimpleImageDownloader) {
+		d.retry = policy
+	}
+}
+
+// backoff returns the delay before the retry: a random value between the half and the whole of the exponential delay.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.Delay
+	for i := 0; i < retry && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// send sends the request retrying the transient failures, the circuit breaker is checked before every attempt.
+func (d SimpleImageDownloader) send(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Host
+	for retry := 0; ; retry++ {
+		if d.breaker != nil {
+			if err := d.breaker.allow(host); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := d.client.Do(req)
+		if d.breaker != nil {
+			if ctx.Err() != nil {
+				d.breaker.cancel(host)
+			} else {
+				d.breaker.record(host, hostFailed(res, err))
+			}
+		}
+		// the canceled or expired request is not retried
+		if ctx.Err() != nil || retry >= d.retry.Retries || !transient(res, err) {
+			return res, err
+		}
+		if res != nil {
+			io.CopyN(io.Discard, res.Body, maxDrainSize)
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(d.retry.backoff(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// transient reports whether the failed download may succeed if retried,
+// the other errors (e.g. TLS verification or the forbidden address) would fail again.
+func transient(res *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// hostFailed reports whether the download counts as the failure of the host for the circuit breaker.
+func hostFailed(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, httpserver.ErrForbiddenAddress)
+	}
+	return res.StatusCode >= 500
+}
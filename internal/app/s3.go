@@ -0,0 +1,248 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bardex/minipic/internal/httpserver"
+)
+
+const (
+	// S3Scheme the scheme of the images in S3-compatible object storages: s3://<bucket>/<key>.
+	S3Scheme = "s3"
+
+	s3DefaultRegion = "us-east-1"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	// s3EmptyPayload SHA256 of the empty body of the GET request.
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Bucket the location and the credentials of the bucket.
+type S3Bucket struct {
+	// Endpoint the URL of the storage, e.g. http://minio:9000, by default https://s3.<region>.amazonaws.com.
+	Endpoint string
+	Region   string
+	// PathStyle address the bucket as <endpoint>/<bucket>/<key> instead of <bucket>.<endpoint host>/<key>.
+	PathStyle bool
+	// AccessKey and SecretKey the credentials, the requests without the access key are anonymous.
+	AccessKey string
+	SecretKey string
+}
+
+// S3Downloader downloads s3://<bucket>/<key> objects signing the requests with AWS Signature Version 4.
+type S3Downloader struct {
+	http      SimpleImageDownloader
+	defaults  S3Bucket
+	buckets   map[string]S3Bucket
+	anyBucket bool
+	now       func() time.Time
+}
+
+// NewS3Downloader returns the downloader of the objects in the buckets.
+// The other buckets are forbidden, unless anyBucket is set, then they are requested with the default settings
+// and credentials. The storage hosts are trusted, see newTrustedDownloader.
+func NewS3Downloader(
+	defaults S3Bucket, buckets map[string]S3Bucket, anyBucket bool, opts ...DownloaderOption,
+) S3Downloader {
+	return S3Downloader{
+		http:      newTrustedDownloader(opts),
+		defaults:  defaults,
+		buckets:   buckets,
+		anyBucket: anyBucket,
+		now:       time.Now,
+	}
+}
+
+func (d S3Downloader) Download(ctx context.Context, rawURL string, headers http.Header) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != S3Scheme || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("image URL must look like s3://<bucket>/<key>: %s", rawURL)
+	}
+
+	bucket, ok := d.buckets[u.Host]
+	if !ok {
+		if !d.anyBucket {
+			return nil, fmt.Errorf("%w: unknown bucket %s", httpserver.ErrSourceForbidden, u.Host)
+		}
+		bucket = d.defaults
+	}
+	objectURL, err := bucket.objectURL(u.Host, u.Path, u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range clientHeaders(headers) {
+		// the x-amz-* headers must be signed
+		if k == "Cookie" || strings.HasPrefix(strings.ToLower(k), "x-amz-") {
+			continue
+		}
+		req.Header[k] = v
+	}
+	if bucket.AccessKey != "" {
+		signV4(req, bucket, d.now())
+	}
+	return d.http.do(req, nil)
+}
+
+// objectURL returns the HTTP URL of the object.
+func (b S3Bucket) objectURL(bucket, key, query string) (string, error) {
+	region := b.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.New("invalid S3 endpoint")
+	}
+	if e.Host == "" {
+		return "", fmt.Errorf("invalid S3 endpoint: %s", e.Redacted())
+	}
+
+	path := s3EscapePath(key)
+	if b.PathStyle {
+		path = s3EscapePath(bucket) + path
+	} else {
+		e.Host = bucket + "." + e.Host
+	}
+	u := e.Scheme + "://" + e.Host + strings.TrimRight(e.EscapedPath(), "/") + path
+	if query != "" {
+		u += "?" + query
+	}
+	return u, nil
+}
+
+// signV4 adds the AWS Signature Version 4 Authorization header to the GET request.
+// The signed headers are host, range and x-amz-*.
+func signV4(req *http.Request, bucket S3Bucket, now time.Time) {
+	region := bucket.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3EmptyPayload,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+bucket.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, bucket.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3EscapePath escapes the object key, the slashes are kept.
+func s3EscapePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return s3Escape(path, false)
+}
+
+// s3Escape escapes everything except the unreserved characters as required by the signature.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (b S3Bucket) String() string {
+	secret := ""
+	if b.SecretKey != "" {
+		secret = "[REDACTED]"
+	}
+	return fmt.Sprintf("{Endpoint:%s Region:%s PathStyle:%t AccessKey:%s SecretKey:%s}",
+		b.Endpoint, b.Region, b.PathStyle, b.AccessKey, secret)
+}
+
+func (b S3Bucket) GoString() string {
+	return "app.S3Bucket" + b.String()
+}
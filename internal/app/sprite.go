@@ -0,0 +1,78 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"sync"
+
+	"github.com/bardex/minipic/internal/httpserver"
+	"github.com/disintegration/imaging"
+)
+
+// composeWorkers the number of the images of the sprite decoded and resized at once.
+const composeWorkers = 4
+
+// Compose resizes the images with the fill mode and tiles them into a grid row by row,
+// the tile of a nil source or of the image which failed to decode is left transparent.
+func (r Resizer) Compose(srcs []io.Reader, dst io.Writer, opts httpserver.SpriteOptions) ([]error, error) {
+	rows := (len(srcs) + opts.Columns - 1) / opts.Columns
+	width, height := opts.Columns*opts.TileWidth, rows*opts.TileHeight
+	if err := r.checkOutputResolution(width, height); err != nil {
+		return nil, err
+	}
+
+	sprite := image.NewNRGBA(image.Rect(0, 0, width, height))
+	errs := make([]error, len(srcs))
+	workers := make(chan struct{}, composeWorkers)
+	var wg sync.WaitGroup
+	for i, src := range srcs {
+		if src == nil {
+			continue
+		}
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, src io.Reader) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			data, err := io.ReadAll(src)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			img, _, err := decode(data, r.MaxSourcePixels)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			tile := imaging.Fill(img, opts.TileWidth, opts.TileHeight, imaging.Center, imaging.Lanczos)
+			x, y := i%opts.Columns*opts.TileWidth, i/opts.Columns*opts.TileHeight
+			// the tiles do not overlap, so they are drawn concurrently
+			draw.Draw(sprite, image.Rect(x, y, x+opts.TileWidth, y+opts.TileHeight), tile, image.Point{}, draw.Src)
+		}(i, src)
+	}
+	wg.Wait()
+
+	var buf bytes.Buffer
+	var err error
+	switch opts.Format {
+	case "jpeg":
+		err = imaging.Encode(&buf, sprite, imaging.JPEG, imaging.JPEGQuality(defaultJPEGQuality))
+	case "png":
+		err = imaging.Encode(&buf, sprite, imaging.PNG, imaging.PNGCompressionLevel(png.BestCompression))
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnsupportedFormat, opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dst.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
@@ -0,0 +1,167 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bardex/minipic/internal/httpserver"
+)
+
+// forbiddenNetworks special-purpose networks which are not covered by the net.IP methods
+// (loopback, private, link-local including the cloud metadata 169.254.169.254, multicast, unspecified).
+var forbiddenNetworks = mustParseNetworks([]string{
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, including broadcast
+	"64:ff9b::/96",    // NAT64, maps to any IPv4 address
+	"64:ff9b:1::/48",  // local-use NAT64
+	"100::/64",        // discard-only
+	"2001::/32",       // Teredo, maps to any IPv4 address
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, maps to any IPv4 address
+	"fec0::/10",       // deprecated site-local
+})
+
+// guardedDialer refuses connections to private, loopback, link-local and other internal addresses.
+// The check is made on the resolved IP right before connecting, so it covers redirects and DNS rebinding.
+type guardedDialer struct {
+	dialer          *net.Dialer
+	resolver        *net.Resolver
+	allowedHosts    map[string]bool
+	allowedNetworks []*net.IPNet
+	// proxyHost the configured HTTP proxy, the image hosts are checked before the requests to it.
+	proxyHost string
+}
+
+// WithAllowedTargets allows connections to the internal hosts and networks which are legitimate image origins.
+func WithAllowedTargets(hosts []string, networks []*net.IPNet) DownloaderOption {
+	return func(d *SimpleImageDownloader) {
+		for _, host := range hosts {
+			d.allowedHosts[strings.ToLower(host)] = true
+		}
+		d.allowedNetworks = append(d.allowedNetworks, networks...)
+	}
+}
+
+// ParseNetworks parses CIDR networks, a single IP address is treated as the network of one address.
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseNetworks(cidrs []string) []*net.IPNet {
+	networks, err := ParseNetworks(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// trustedHostKey the context key of the host of the request which is not checked, see newTrustedDownloader.
+type trustedHostKey struct{}
+
+// trusted reports whether the connections to the host are not checked.
+func (g guardedDialer) trusted(ctx context.Context, host string) bool {
+	if g.allowedHosts[strings.ToLower(host)] {
+		return true
+	}
+	trustedHost, _ := ctx.Value(trustedHostKey{}).(string)
+	return trustedHost != "" && strings.EqualFold(host, trustedHost)
+}
+
+func (g guardedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if g.trusted(ctx, host) || (g.proxyHost != "" && strings.ToLower(host) == g.proxyHost) {
+		return g.dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := g.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the checked addresses are dialed, a repeated resolution could return another ones
+	var lastErr error
+	for _, ip := range ips {
+		if !g.isAllowed(ip.IP) {
+			lastErr = fmt.Errorf("%w: %s resolves to %s", httpserver.ErrForbiddenAddress, host, ip.IP)
+			continue
+		}
+		conn, err := g.dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%w: %s does not resolve", httpserver.ErrForbiddenAddress, host)
+	}
+	return nil, lastErr
+}
+
+// check returns ErrForbiddenAddress if the host resolves to an address which is not allowed.
+func (g guardedDialer) check(ctx context.Context, host string) error {
+	if g.trusted(ctx, host) {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !g.isAllowed(ip) {
+			return fmt.Errorf("%w: %s", httpserver.ErrForbiddenAddress, host)
+		}
+		return nil
+	}
+	ips, err := g.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !g.isAllowed(ip.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", httpserver.ErrForbiddenAddress, host, ip.IP)
+		}
+	}
+	return nil
+}
+
+func (g guardedDialer) isAllowed(ip net.IP) bool {
+	for _, network := range g.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range forbiddenNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
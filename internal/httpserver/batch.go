@@ -0,0 +1,201 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	batchPrefix = "batch"
+	// maxBatchSizes the maximum number of sizes in the batch request.
+	maxBatchSizes = 10
+)
+
+// BatchResizer resizes the source image into several sizes decoding it once,
+// the result of opts[i] is written to dsts[i].
+type BatchResizer interface {
+	ResizeBatch(src io.Reader, dsts []io.Writer, opts []ResizeOptions) ([]ResizeResult, error)
+}
+
+// ResponseStore stores the responses under the keys of the requests, e.g. app.LruCache.
+type ResponseStore interface {
+	Save(key string, headers http.Header, body []byte) error
+}
+
+// Storable reports whether the shared cache may store the response.
+// The placeholder is not stored, because the cache does not expire it.
+func Storable(headers http.Header) bool {
+	if headers.Get(PlaceholderHeader) != "" {
+		return false
+	}
+	cacheControl := strings.ToLower(headers.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "private") && !strings.Contains(cacheControl, "no-store")
+}
+
+// WithCache stores the renditions of the batch requests under the keys of the corresponding single-size requests.
+func WithCache(store ResponseStore) HandlerOption {
+	return func(h *Handler) {
+		h.store = store
+	}
+}
+
+type batchRendition struct {
+	// size the size as given in the request: <mode>:<width>:<height>.
+	size string
+	opts ResizeOptions
+}
+
+// serveBatch serves /batch/<mode>:<width>:<height>,.../[<option>:<value>/]<image_url> as a multipart response
+// with a part per size in the order of the request.
+func (h Handler) serveBatch(w http.ResponseWriter, r *http.Request, uri string, expires time.Time) {
+	resizer, ok := h.resizer.(BatchResizer)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	src, rest, renditions, err := h.parseBatchURI(uri)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	ctx, cancel := h.downloadContext(r)
+	defer cancel()
+
+	res, err := h.downloader.Download(ctx, src, h.requestHeaders.filter(r.Header))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer res.Body.Close()
+
+	res.Header.Del("Content-Length")
+
+	upstream := h.responseHeaders.filter(res.Header)
+	for k, v := range upstream {
+		w.Header()[k] = v
+	}
+	setExpires(w, expires)
+
+	if res.StatusCode != http.StatusOK {
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return
+	}
+
+	imgs := make([]bytes.Buffer, len(renditions))
+	dsts := make([]io.Writer, len(renditions))
+	opts := make([]ResizeOptions, len(renditions))
+	for i := range renditions {
+		dsts[i] = &imgs[i]
+		opts[i] = renditions[i].opts
+	}
+	results, err := resizer.ResizeBatch(res.Body, dsts, opts)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, rendition := range renditions {
+		headers := renditionHeaders(results[i], imgs[i].Len())
+		if h.store != nil && expires.IsZero() {
+			h.storeRendition(r, rendition, rest, upstream, headers, imgs[i].Bytes())
+		}
+
+		headers.Set("X-Minipic-Size", rendition.size)
+		part, err := mw.CreatePart(textproto.MIMEHeader(headers))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		part.Write(imgs[i].Bytes())
+	}
+	mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	io.Copy(w, &body)
+}
+
+// storeRendition saves the rendition under the key of the single-size request /<mode>/<width>/<height>/<rest>.
+func (h Handler) storeRendition(
+	r *http.Request, rendition batchRendition, rest string, upstream, headers http.Header, img []byte,
+) {
+	uri := "/" + strings.Join([]string{
+		rendition.opts.Mode, strconv.Itoa(rendition.opts.Width), strconv.Itoa(rendition.opts.Height), rest,
+	}, "/")
+	key := h.signature.resign(r.URL.RequestURI(), uri)
+
+	stored := upstream.Clone()
+	for k, v := range headers {
+		stored[k] = v
+	}
+	// the single-size response of the private image is not stored either
+	if !Storable(stored) {
+		return
+	}
+	if err := h.store.Save(key, stored, img); err != nil {
+		log.Println(err)
+	}
+}
+
+func renditionHeaders(result ResizeResult, size int) http.Header {
+	headers := http.Header{}
+	if result.Format != "" {
+		headers.Set("Content-Type", "image/"+result.Format)
+	}
+	if result.Quality > 0 {
+		headers.Set("X-Minipic-Quality", strconv.Itoa(result.Quality))
+	}
+	headers.Set("Content-Length", strconv.Itoa(size))
+	return headers
+}
+
+// parseBatchURI returns the image URL, the part of the URI after the sizes and the renditions.
+func (h Handler) parseBatchURI(uri string) (src string, rest string, renditions []batchRendition, err error) {
+	params := strings.SplitN(strings.TrimPrefix(uri, "/"+batchPrefix+"/"), "/", 2)
+	if len(params) != 2 || params[0] == "" {
+		err = errors.New("request URL should look like /batch/<mode>:<width>:<height>,.../[<option>:<value>/]<image_url>")
+		return
+	}
+	rest = params[1]
+
+	sizes := strings.Split(params[0], ",")
+	if len(sizes) > maxBatchSizes {
+		err = fmt.Errorf("batch request must contain at most %d sizes", maxBatchSizes)
+		return
+	}
+	var srcURI string
+	for _, size := range sizes {
+		parts := strings.Split(size, ":")
+		if len(parts) != 3 {
+			err = fmt.Errorf("size `%s` should look like <mode>:<width>:<height>", size)
+			return
+		}
+		var opts ResizeOptions
+		opts, err = h.sizeOptions(parts[0], parts[1], parts[2])
+		if err != nil {
+			return
+		}
+		srcURI, err = parseOptions(rest, &opts)
+		if err != nil {
+			return
+		}
+		renditions = append(renditions, batchRendition{size: size, opts: opts})
+	}
+
+	src, err = h.parseSource(srcURI)
+	return
+}
@@ -0,0 +1,201 @@
+package httpserver
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bardex/minipic/pkg/client"
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientRoundTrip checks that the URLs built by the client package are parsed by the Handler into the same options.
+func TestClientRoundTrip(t *testing.T) {
+	keys := map[string]string{"k1": "old-key", "k2": "new-key"}
+	h := NewHandler(
+		nil,
+		nil,
+		WithSignature(keys, true),
+		WithDefaults(ResizeOptions{Palette: 64}),
+		WithOrigins("products"),
+		WithSchemes("local", "s3"),
+	).(Handler)
+
+	plain := client.New("https://img.example.com/")
+	signed := client.New("https://img.example.com", client.WithKey("k2", "new-key"))
+	expires := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		builder client.Builder
+		build   func(b client.Builder) (string, error)
+		src     string
+		opts    ResizeOptions
+	}{
+		{
+			name:    "fit",
+			builder: client.New("https://img.example.com", client.WithUnsafe()),
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(800, 600).URL("https://example.com/image.jpeg")
+			},
+			src:  "https://example.com/image.jpeg",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 800, Height: 600, Palette: 64},
+		},
+		{
+			name:    "fill with options",
+			builder: signed,
+			build: func(b client.Builder) (string, error) {
+				return b.Fill(300, 200).Progressive(true).Palette(0).MaxBytes(40000).URL("http://example.com/a/image.png")
+			},
+			src:  "http://example.com/a/image.png",
+			opts: ResizeOptions{Mode: ResizeModeFill, Width: 300, Height: 200, Progressive: true, MaxBytes: 40000},
+		},
+		{
+			name:    "escaped source",
+			builder: signed,
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(100, 100).URL("https://example.com/my image.jpeg#preview")
+			},
+			src:  "https://example.com/my%20image.jpeg",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 100, Height: 100, Palette: 64},
+		},
+		{
+			name:    "source with query",
+			builder: signed,
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(100, 100).URL("https://bucket.s3.amazonaws.com/a%2Fb.jpeg?X-Amz-Signature=abc%2Bdef&X-Amz-Expires=300")
+			},
+			src:  "https://bucket.s3.amazonaws.com/a%2Fb.jpeg?X-Amz-Signature=abc%2Bdef&X-Amz-Expires=300",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 100, Height: 100, Palette: 64},
+		},
+		{
+			name:    "origin",
+			builder: signed,
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(100, 100).URL("@products/a/sku123.jpg")
+			},
+			src:  "origin://products/a/sku123.jpg",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 100, Height: 100, Palette: 64},
+		},
+		{
+			name:    "origin with query",
+			builder: signed,
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(100, 100).URL("@products/sku%2F1.jpg?v=2")
+			},
+			src:  "origin://products/sku%2F1.jpg?v=2",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 100, Height: 100, Palette: 64},
+		},
+		{
+			name:    "local",
+			builder: signed,
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(100, 100).URL("local:///a/image.jpeg")
+			},
+			src:  "local:///a/image.jpeg",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 100, Height: 100, Palette: 64},
+		},
+		{
+			name:    "s3 with query",
+			builder: signed,
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(100, 100).URL("s3://originals/a/image%201.jpeg?versionId=3")
+			},
+			src:  "s3://originals/a/image%201.jpeg?versionId=3",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 100, Height: 100, Palette: 64},
+		},
+		{
+			name:    "signed without key ID",
+			builder: client.New("https://img.example.com", client.WithKey("", "old-key")),
+			build: func(b client.Builder) (string, error) {
+				return b.Fit(100, 100).Palette(2).URL("https://example.com/image.jpeg")
+			},
+			src:  "https://example.com/image.jpeg",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 100, Height: 100, Palette: 2},
+		},
+		{
+			name:    "expiring",
+			builder: signed.Expires(expires),
+			build: func(b client.Builder) (string, error) {
+				return b.Fill(100, 100).Progressive(false).URL("https://example.com/image.jpeg")
+			},
+			src:  "https://example.com/image.jpeg",
+			opts: ResizeOptions{Mode: ResizeModeFill, Width: 100, Height: 100, Palette: 64},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			built, err := tt.build(tt.builder)
+			require.NoError(t, err)
+			u, err := url.Parse(built)
+			require.NoError(t, err)
+			require.Equal(t, "img.example.com", u.Host)
+
+			uri, _, err := h.signature.verify(u.RequestURI())
+			require.NoError(t, err)
+			src, opts, err := h.parseRequestURI(uri)
+			require.NoError(t, err)
+			require.Equal(t, tt.src, src)
+			require.Equal(t, tt.opts, opts)
+		})
+	}
+
+	t.Run("hash", func(t *testing.T) {
+		built, err := signed.Expires(expires).Compare("https://example.com/1.jpeg?v=1", "https://example.com/2.jpeg")
+		require.NoError(t, err)
+		u, err := url.Parse(built)
+		require.NoError(t, err)
+
+		uri, exp, err := h.signature.verify(u.RequestURI())
+		require.NoError(t, err)
+		require.Equal(t, expires.Unix(), exp.Unix())
+		srcs, err := h.parseHashURI(uri)
+		require.NoError(t, err)
+		require.Equal(t, []string{"https://example.com/1.jpeg?v=1", "https://example.com/2.jpeg"}, srcs)
+	})
+
+	t.Run("compare with origin", func(t *testing.T) {
+		built, err := signed.Compare("https://example.com/@user/1.jpeg", "@products/2.jpeg")
+		require.NoError(t, err)
+		u, err := url.Parse(built)
+		require.NoError(t, err)
+
+		uri, _, err := h.signature.verify(u.RequestURI())
+		require.NoError(t, err)
+		srcs, err := h.parseHashURI(uri)
+		require.NoError(t, err)
+		require.Equal(t, []string{"https://example.com/@user/1.jpeg", "origin://products/2.jpeg"}, srcs)
+	})
+
+	t.Run("compare local and s3", func(t *testing.T) {
+		built, err := signed.Compare("local:///1.jpeg", "s3://originals/2.jpeg")
+		require.NoError(t, err)
+		u, err := url.Parse(built)
+		require.NoError(t, err)
+
+		uri, _, err := h.signature.verify(u.RequestURI())
+		require.NoError(t, err)
+		srcs, err := h.parseHashURI(uri)
+		require.NoError(t, err)
+		require.Equal(t, []string{"local:///1.jpeg", "s3://originals/2.jpeg"}, srcs)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := plain.Fit(5, 100).URL("https://example.com/image.jpeg")
+		require.Error(t, err)
+		_, err = plain.Fit(100, 100).URL("/image.jpeg")
+		require.Error(t, err)
+		_, err = plain.Fit(100, 100).URL("@products/")
+		require.Error(t, err)
+		_, err = plain.Fit(100, 100).URL("local://host/image.jpeg")
+		require.Error(t, err)
+		_, err = plain.Fit(100, 100).URL("s3://originals/")
+		require.Error(t, err)
+		_, err = plain.Fit(100, 100).URL("ftp://example.com/image.jpeg")
+		require.Error(t, err)
+		_, err = plain.Expires(expires).Hash("https://example.com/image.jpeg")
+		require.Error(t, err)
+	})
+}
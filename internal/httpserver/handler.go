@@ -19,61 +19,189 @@ const (
 
 	// ResizeModeFill fill given dimensions with image.
 	ResizeModeFill = "fill"
+
+	// minSize the minimum width and height of the resized image.
+	minSize = 10
+
+	// defaultTimeout the default time limit of downloading and processing the images of the request.
+	defaultTimeout = 10 * time.Second
 )
 
 type Downloader interface {
 	Download(ctx context.Context, URL string, headers http.Header) (*http.Response, error)
 }
 
+var (
+	// ErrMaxBytesUnreachable the image can not be encoded into the requested number of bytes.
+	ErrMaxBytesUnreachable = errors.New("image can not be encoded into the requested number of bytes")
+	// ErrSourceResolution the source image resolution exceeds the limit.
+	ErrSourceResolution = errors.New("source image resolution is too large")
+	// ErrOutputResolution the resized image resolution exceeds the limit.
+	ErrOutputResolution = errors.New("resized image resolution is too large")
+	// ErrSourceTooLarge the source image size in bytes exceeds the limit.
+	ErrSourceTooLarge = errors.New("source image is too large")
+	// ErrForbiddenAddress the image host resolves to a private or internal address.
+	ErrForbiddenAddress = errors.New("image host address is forbidden")
+	// ErrSourceUnavailable the image host failed several times in a row and is not requested for a while.
+	ErrSourceUnavailable = errors.New("image host is unavailable")
+)
+
 type ImageResizer interface {
-	Resize(src io.Reader, dst io.Writer, opts ResizeOptions) error
+	Resize(src io.Reader, dst io.Writer, opts ResizeOptions) (ResizeResult, error)
 }
 
 type ResizeOptions struct {
 	Mode   string
 	Width  int
 	Height int
+	// Progressive encode JPEG as progressive.
+	Progressive bool
+	// Palette quantize PNG to the given number of colors, 0 keeps full color.
+	Palette int
+	// MaxBytes lower JPEG quality until the image fits into the given number of bytes, 0 - no limit.
+	MaxBytes int
+}
+
+// ResizeResult parameters chosen while encoding the resized image.
+type ResizeResult struct {
+	// Format image format of the resized image: jpeg or png.
+	Format string
+	// Quality JPEG quality, 0 for lossless formats.
+	Quality int
 }
 
 type Handler struct {
-	downloader Downloader
-	resizer    ImageResizer
+	downloader  Downloader
+	resizer     ImageResizer
+	hasher      ImageHasher
+	uploadSize  int64
+	defaults    ResizeOptions
+	sources     sourceRules
+	signature   signature
+	store       ResponseStore
+	inspector   ImageInspector
+	srcset      Srcset
+	schemes     map[string]bool
+	origins     map[string]bool
+	placeholder placeholder
+	timeout     time.Duration
+
+	requestHeaders  HeaderPolicy
+	responseHeaders HeaderPolicy
+}
+
+// HandlerOption configures optional features of the Handler.
+type HandlerOption func(h *Handler)
+
+// WithSchemes allows the image URLs with the schemes other than http and https, which are supported by the downloader.
+func WithSchemes(schemes ...string) HandlerOption {
+	return func(h *Handler) {
+		if h.schemes == nil {
+			h.schemes = make(map[string]bool, len(schemes))
+		}
+		for _, scheme := range schemes {
+			h.schemes[scheme] = true
+		}
+	}
 }
 
-func NewHandler(d Downloader, r ImageResizer) http.Handler {
-	return Handler{
+// WithTimeout limits the time of downloading and processing the images of the request, 10s by default.
+func WithTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) {
+		if timeout > 0 {
+			h.timeout = timeout
+		}
+	}
+}
+
+func NewHandler(d Downloader, r ImageResizer, opts ...HandlerOption) http.Handler {
+	h := Handler{
 		downloader: d,
 		resizer:    r,
+		timeout:    defaultTimeout,
+
+		requestHeaders:  DefaultRequestHeaders,
+		responseHeaders: DefaultResponseHeaders,
 	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	return h
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && !(r.Method == http.MethodPost && h.uploadSize > 0) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	src, opts, err := h.parseRequestURI(r.URL.RequestURI())
+	uri, expires, err := h.signature.verify(r.URL.RequestURI())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), requestErrorStatus(err))
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if r.Method == http.MethodPost {
+		h.serveUpload(w, r, uri)
+		return
+	}
+
+	if strings.HasPrefix(uri, "/"+hashPrefix+"/") {
+		setExpires(w, expires)
+		h.serveHash(w, r, uri)
+		return
+	}
+
+	if strings.HasPrefix(uri, "/"+srcsetPrefix+"/") {
+		setExpires(w, expires)
+		h.serveSrcset(w, r, uri)
+		return
+	}
+
+	if isSpriteURI(uri) {
+		setExpires(w, expires)
+		h.serveSprite(w, r, uri)
+		return
+	}
+
+	if strings.HasPrefix(uri, "/"+batchPrefix+"/") {
+		h.serveBatch(w, r, uri, expires)
+		return
+	}
+
+	parse := h.parseRequestURI
+	if isQueryURI(uri) {
+		parse = h.parseQueryURI
+	}
+	src, opts, err := parse(uri)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	ctx, cancel := h.downloadContext(r)
 	defer cancel()
 
-	res, err := h.downloader.Download(ctx, src, r.Header.Clone())
+	res, err := h.downloader.Download(ctx, src, h.requestHeaders.filter(r.Header))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		if replaceable(err, 0) && h.servePlaceholder(w, opts, expires) {
+			return
+		}
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode >= 400 && replaceable(nil, res.StatusCode) && h.servePlaceholder(w, opts, expires) {
+		return
+	}
+
 	res.Header.Del("Content-Length")
 
-	for k, v := range res.Header {
+	for k, v := range h.responseHeaders.filter(res.Header) {
 		w.Header()[k] = v
 	}
+	setExpires(w, expires)
 
 	if res.StatusCode != 200 {
 		w.WriteHeader(res.StatusCode)
@@ -81,11 +209,34 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.resize(w, res.Body, opts, http.StatusBadGateway)
+}
+
+// downloadContext limits the time of downloading and processing the images of the request,
+// the downloads are canceled when the client goes away.
+func (h Handler) downloadContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), h.timeout)
+}
+
+// resize writes the resized image to the response,
+// invalidSourceStatus is the status of the errors caused by the source image (e.g. unsupported format).
+func (h Handler) resize(w http.ResponseWriter, src io.Reader, opts ResizeOptions, invalidSourceStatus int) {
 	var img bytes.Buffer
-	if err = h.resizer.Resize(res.Body, &img, opts); err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+	result, err := h.resizer.Resize(src, &img, opts)
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusBadGateway {
+			status = invalidSourceStatus
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
+	if result.Format != "" {
+		w.Header().Set("Content-Type", "image/"+result.Format)
+	}
+	if result.Quality > 0 {
+		w.Header().Set("X-Minipic-Quality", strconv.Itoa(result.Quality))
+	}
 	w.Header().Set("Content-Length", strconv.Itoa(img.Len()))
 	io.Copy(w, &img)
 }
@@ -94,39 +245,118 @@ func (h Handler) parseRequestURI(uri string) (src string, opts ResizeOptions, er
 	uri = strings.Trim(uri, "/")
 	params := strings.SplitN(uri, "/", 4)
 	if len(params) != 4 {
-		err = errors.New("request URL should look like /<mode>/<width>/<height>/<image_url>")
+		err = errors.New("request URL should look like /<mode>/<width>/<height>/[<option>:<value>/][b64/|plain/]<image_url>")
 		return
 	}
-	mode := params[0]
-	if mode != ResizeModeFill && mode != ResizeModeFit {
-		err = fmt.Errorf("resize mode must be `%s` or `%s`", ResizeModeFill, ResizeModeFit)
+	opts, err = h.sizeOptions(params[0], params[1], params[2])
+	if err != nil {
 		return
 	}
-	width, err := strconv.Atoi(params[1])
+	rest, err := parseOptions(params[3], &opts)
 	if err != nil {
-		err = errors.New("image width must be integer")
 		return
 	}
-	height, err := strconv.Atoi(params[2])
+
+	src, err = h.parseSource(rest)
+	return
+}
+
+// sizeOptions returns the default options with the checked mode and size.
+func (h Handler) sizeOptions(mode, width, height string) (ResizeOptions, error) {
+	if mode != ResizeModeFill && mode != ResizeModeFit {
+		return ResizeOptions{}, fmt.Errorf("resize mode must be `%s` or `%s`", ResizeModeFill, ResizeModeFit)
+	}
+	widthPx, err := strconv.Atoi(width)
 	if err != nil {
-		err = errors.New("image height must be integer")
-		return
+		return ResizeOptions{}, errors.New("image width must be integer")
 	}
-	if width < 10 || height < 10 {
-		err = errors.New("width and height must be more than 10px")
-		return
+	heightPx, err := strconv.Atoi(height)
+	if err != nil {
+		return ResizeOptions{}, errors.New("image height must be integer")
 	}
-
-	imgSrc, err := url.ParseRequestURI(params[3])
-	if err != nil || (imgSrc.Scheme != "http" && imgSrc.Scheme != "https") || imgSrc.Host == "" {
-		err = errors.New("image URL must be absolute")
-		return
+	if widthPx < minSize || heightPx < minSize {
+		return ResizeOptions{}, errors.New("width and height must be more than 10px")
 	}
 
-	src = params[3]
+	opts := h.defaults
 	opts.Mode = mode
-	opts.Width = width
-	opts.Height = height
+	opts.Width = widthPx
+	opts.Height = heightPx
+	return opts, nil
+}
 
-	return
+// errorStatus maps the download or resize error to the response status.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSourceTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrForbiddenAddress), errors.Is(err, ErrSourceForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrSourceUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrMaxBytesUnreachable), errors.Is(err, ErrSourceResolution):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrOutputResolution):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadGateway
+}
+
+// requestErrorStatus maps the request URI parse error to the response status.
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSourceForbidden), errors.Is(err, ErrInvalidSignature):
+		return http.StatusForbidden
+	case errors.Is(err, ErrExpiredSignature):
+		return http.StatusGone
+	}
+	return http.StatusBadRequest
+}
+
+// setExpires forbids shared caches (including the minipic cache) to store the response of the expiring URL,
+// otherwise it would be served after the expiry.
+func setExpires(w http.ResponseWriter, expires time.Time) {
+	if expires.IsZero() {
+		return
+	}
+	maxAge := int(time.Until(expires).Seconds())
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(maxAge))
+}
+
+// parseSource decodes and checks the image URL given as is, as b64/<base64url>, as plain/<percent-encoded>
+// or as @<origin>/<path>.
+func (h Handler) parseSource(src string) (string, error) {
+	src, err := decodeSource(src)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(src, originPrefix) {
+		if src, err = h.resolveOrigin(src); err != nil {
+			return "", err
+		}
+	}
+	imgSrc, err := url.ParseRequestURI(src)
+	if err != nil {
+		return "", errors.New("image URL must be absolute")
+	}
+	switch {
+	case imgSrc.Scheme == "http" || imgSrc.Scheme == "https":
+		if imgSrc.Host == "" {
+			return "", errors.New("image URL must be absolute")
+		}
+	case imgSrc.Scheme == OriginScheme:
+		if !h.origins[imgSrc.Host] {
+			return "", fmt.Errorf("unknown origin: %s", imgSrc.Host)
+		}
+	case h.schemes[imgSrc.Scheme]:
+		if imgSrc.Path == "" {
+			return "", fmt.Errorf("image URL must have a path: %s", src)
+		}
+	default:
+		return "", errors.New("image URL must be absolute")
+	}
+	if err = h.sources.check(imgSrc); err != nil {
+		return "", err
+	}
+	return src, nil
 }
@@ -0,0 +1,122 @@
+package httpserver
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestURISource(t *testing.T) {
+	h := NewHandler(nil, nil).(Handler)
+	s3 := "https://bucket.s3.amazonaws.com/a%2Fb/image.jpeg?X-Amz-Signature=abc%2Bdef&X-Amz-Expires=300#thumb"
+
+	tests := []struct {
+		name string
+		uri  string
+		src  string
+		err  bool
+	}{
+		{name: "as is", uri: "/fit/100/100/https://example.com/image.jpeg", src: "https://example.com/image.jpeg"},
+		{
+			name: "as is with query",
+			uri:  "/fit/100/100/https://example.com/image.jpeg?v=1",
+			src:  "https://example.com/image.jpeg?v=1",
+		},
+		{
+			name: "base64",
+			uri:  "/fit/100/100/b64/" + base64.RawURLEncoding.EncodeToString([]byte(s3)),
+			src:  s3,
+		},
+		{
+			name: "padded base64",
+			uri:  "/fit/100/100/b64/" + base64.URLEncoding.EncodeToString([]byte("https://example.com/i.jpeg")),
+			src:  "https://example.com/i.jpeg",
+		},
+		{
+			name: "base64 after options",
+			uri:  "/fit/100/100/progressive:1/b64/" + base64.RawURLEncoding.EncodeToString([]byte(s3)),
+			src:  s3,
+		},
+		{name: "plain", uri: "/fit/100/100/plain/" + url.PathEscape(s3), src: s3},
+		{name: "plain after options", uri: "/fit/100/100/palette:16/plain/" + url.QueryEscape(s3), src: s3},
+		{
+			name: "plain not encoded",
+			uri:  "/fit/100/100/plain/https://example.com/image.jpeg",
+			src:  "https://example.com/image.jpeg",
+		},
+		{name: "invalid base64", uri: "/fit/100/100/b64/aHR0c#$", err: true},
+		{
+			name: "base64 of relative URL",
+			uri:  "/fit/100/100/b64/" + base64.RawURLEncoding.EncodeToString([]byte("/image.jpeg")),
+			err:  true,
+		},
+		{name: "invalid percent-encoding", uri: "/fit/100/100/plain/https%3A%2F%2Fexample.com%2Fimage%ZZ", err: true},
+		{name: "empty base64", uri: "/fit/100/100/b64/", err: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			src, opts, err := h.parseRequestURI(tt.uri)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.src, src)
+			require.Equal(t, ResizeModeFit, opts.Mode)
+		})
+	}
+}
+
+func TestParseHashURISource(t *testing.T) {
+	h := NewHandler(nil, nil).(Handler)
+	first := "https://example.com/plain/1.jpeg?v=1"
+	second := "https://example.com/2.jpeg?sig=a%2Fb"
+	b64 := func(s string) string {
+		return "b64/" + base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name string
+		uri  string
+		srcs []string
+		err  bool
+	}{
+		{name: "hash base64", uri: "/hash/" + b64(second), srcs: []string{second}},
+		{name: "hash plain", uri: "/hash/plain/" + url.PathEscape(second), srcs: []string{second}},
+		{
+			name: "compare as is",
+			uri:  "/hash/compare/https://example.com/1.jpeg/http://example.com/2.jpeg",
+			srcs: []string{"https://example.com/1.jpeg", "http://example.com/2.jpeg"},
+		},
+		{name: "compare base64", uri: "/hash/compare/" + b64(first) + "/" + b64(second), srcs: []string{first, second}},
+		{
+			name: "compare plain and base64",
+			uri:  "/hash/compare/plain/" + url.PathEscape(first) + "/" + b64(second),
+			srcs: []string{first, second},
+		},
+		{
+			name: "compare as is and plain",
+			uri:  "/hash/compare/" + first + "/plain/" + url.PathEscape(second),
+			srcs: []string{first, second},
+		},
+		{name: "compare as is and as is", uri: "/hash/compare/" + first + "/" + second, srcs: []string{first, second}},
+		{name: "compare one base64", uri: "/hash/compare/" + b64(first), err: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srcs, err := h.parseHashURI(tt.uri)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.srcs, srcs)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	hashPrefix  = "hash"
+	hashCompare = "compare"
+)
+
+// ImageHash perceptual hashes of an image.
+type ImageHash struct {
+	AHash uint64
+	DHash uint64
+	PHash uint64
+}
+
+type ImageHasher interface {
+	Hash(src io.Reader) (ImageHash, error)
+}
+
+type hashResponse struct {
+	AHash string `json:"ahash"`
+	DHash string `json:"dhash"`
+	PHash string `json:"phash"`
+}
+
+type distanceResponse struct {
+	AHash int `json:"ahash"`
+	DHash int `json:"dhash"`
+	PHash int `json:"phash"`
+}
+
+type compareResponse struct {
+	Distance distanceResponse `json:"distance"`
+	Hashes   []hashResponse   `json:"hashes"`
+}
+
+// WithHasher enables the /hash/ endpoint.
+func WithHasher(hasher ImageHasher) HandlerOption {
+	return func(h *Handler) {
+		h.hasher = hasher
+	}
+}
+
+func (h Handler) serveHash(w http.ResponseWriter, r *http.Request, uri string) {
+	if h.hasher == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	srcs, err := h.parseHashURI(uri)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	ctx, cancel := h.downloadContext(r)
+	defer cancel()
+
+	hashes := make([]ImageHash, 0, len(srcs))
+	for _, src := range srcs {
+		hash, status, err := h.hashImage(ctx, src, h.requestHeaders.filter(r.Header))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		hashes = append(hashes, hash)
+	}
+
+	var response interface{}
+	if len(hashes) == 1 {
+		response = newHashResponse(hashes[0])
+	} else {
+		response = compareResponse{
+			Distance: distanceResponse{
+				AHash: bits.OnesCount64(hashes[0].AHash ^ hashes[1].AHash),
+				DHash: bits.OnesCount64(hashes[0].DHash ^ hashes[1].DHash),
+				PHash: bits.OnesCount64(hashes[0].PHash ^ hashes[1].PHash),
+			},
+			Hashes: []hashResponse{newHashResponse(hashes[0]), newHashResponse(hashes[1])},
+		}
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+func (h Handler) hashImage(ctx context.Context, src string, headers http.Header) (ImageHash, int, error) {
+	res, err := h.downloader.Download(ctx, src, headers)
+	if err != nil {
+		return ImageHash{}, errorStatus(err), err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return ImageHash{}, res.StatusCode, fmt.Errorf("image %s responded with status %s", src, res.Status)
+	}
+
+	hash, err := h.hasher.Hash(res.Body)
+	if err != nil {
+		return ImageHash{}, errorStatus(err), err
+	}
+	return hash, http.StatusOK, nil
+}
+
+// parseHashURI returns one image URL for /hash/<image_url>
+// or two image URLs for /hash/compare/<image_url>/<image_url>.
+func (h Handler) parseHashURI(uri string) ([]string, error) {
+	uri = strings.TrimPrefix(uri, "/"+hashPrefix+"/")
+
+	if !strings.HasPrefix(uri, hashCompare+"/") {
+		src, err := h.parseSource(uri)
+		if err != nil {
+			return nil, err
+		}
+		return []string{src}, nil
+	}
+
+	uri = strings.TrimPrefix(uri, hashCompare+"/")
+	firstSrc, secondSrc, ok := splitSources(uri)
+	if !ok {
+		return nil, errors.New("request URL should look like /hash/compare/<image_url>/<image_url>")
+	}
+
+	first, err := h.parseSource(firstSrc)
+	if err != nil {
+		return nil, err
+	}
+	second, err := h.parseSource(secondSrc)
+	if err != nil {
+		return nil, err
+	}
+	return []string{first, second}, nil
+}
+
+func newHashResponse(hash ImageHash) hashResponse {
+	return hashResponse{
+		AHash: fmt.Sprintf("%016x", hash.AHash),
+		DHash: fmt.Sprintf("%016x", hash.DHash),
+		PHash: fmt.Sprintf("%016x", hash.PHash),
+	}
+}
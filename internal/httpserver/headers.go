@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderPolicy filters the headers forwarded between the client and the image host, the names are case-insensitive.
+type HeaderPolicy struct {
+	// Allow when not empty, only the listed headers are forwarded.
+	Allow []string
+	// Deny the listed headers are never forwarded.
+	Deny []string
+}
+
+var (
+	// DefaultRequestHeaders the request headers forwarded to the image hosts by default,
+	// so that the cookies and credentials of the client are not sent to the third-party hosts.
+	DefaultRequestHeaders = HeaderPolicy{
+		Allow: []string{"Accept", "Accept-Encoding", "Accept-Language", "User-Agent", "If-Modified-Since", "If-None-Match"},
+	}
+	// DefaultResponseHeaders the response headers returned to the client by default,
+	// so that the image hosts can not set the cookies and security policies of the service domain.
+	DefaultResponseHeaders = HeaderPolicy{
+		Deny: []string{"Set-Cookie", "Set-Cookie2", "Strict-Transport-Security", "Alt-Svc", "Clear-Site-Data"},
+	}
+)
+
+// WithHeaderPolicy filters the request headers forwarded to the image hosts
+// and the response headers returned to the client,
+// DefaultRequestHeaders and DefaultResponseHeaders are used by default.
+func WithHeaderPolicy(request, response HeaderPolicy) HandlerOption {
+	return func(h *Handler) {
+		h.requestHeaders = request
+		h.responseHeaders = response
+	}
+}
+
+// filter returns the copy of the allowed headers.
+func (p HeaderPolicy) filter(headers http.Header) http.Header {
+	filtered := make(http.Header, len(headers))
+	for k, v := range headers {
+		if p.allowed(k) {
+			filtered[k] = append([]string(nil), v...)
+		}
+	}
+	return filtered
+}
+
+func (p HeaderPolicy) allowed(name string) bool {
+	for _, denied := range p.Deny {
+		if strings.EqualFold(name, denied) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range p.Allow {
+		if strings.EqualFold(name, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package httpserver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	headers := http.Header{
+		"User-Agent":    {"Firefox"},
+		"Cookie":        {"session=1"},
+		"Authorization": {"Bearer token"},
+		"Set-Cookie":    {"a=1", "b=2"},
+		"X-Name":        {"test-server"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  HeaderPolicy
+		headers http.Header
+	}{
+		{name: "default request", policy: DefaultRequestHeaders, headers: http.Header{"User-Agent": {"Firefox"}}},
+		{
+			name:   "default response",
+			policy: DefaultResponseHeaders,
+			headers: http.Header{
+				"User-Agent":    {"Firefox"},
+				"Cookie":        {"session=1"},
+				"Authorization": {"Bearer token"},
+				"X-Name":        {"test-server"},
+			},
+		},
+		{
+			name:    "allow and deny",
+			policy:  HeaderPolicy{Allow: []string{"cookie", "x-name"}, Deny: []string{"X-NAME"}},
+			headers: http.Header{"Cookie": {"session=1"}},
+		},
+		{name: "everything", policy: HeaderPolicy{}, headers: headers},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.headers, tt.policy.filter(headers))
+		})
+	}
+
+	// the filtered headers are copied
+	filtered := HeaderPolicy{}.filter(headers)
+	filtered["Set-Cookie"][0] = "c=3"
+	require.Equal(t, "a=1", headers.Get("Set-Cookie"))
+}
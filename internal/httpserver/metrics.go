@@ -0,0 +1,31 @@
+package httpserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// MetricsWriter writes the metrics in the Prometheus text format.
+type MetricsWriter interface {
+	WriteMetrics(w io.Writer) error
+}
+
+// NewMetricsHandler serves the metrics of the writers in the Prometheus text format on /metrics.
+func NewMetricsHandler(writers ...MetricsWriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		for _, writer := range writers {
+			if err := writer.WriteMetrics(&buf); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
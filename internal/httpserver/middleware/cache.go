@@ -7,11 +7,18 @@ import (
 	"net/http/httptest"
 
 	"github.com/bardex/minipic/internal/app"
+	"github.com/bardex/minipic/internal/httpserver"
 )
 
 func NewCache(cache *app.LruCache, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.RequestURI()
+		// the uploaded images differ under the same URL
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := httpserver.CacheKey(r)
 		hit, err := cache.GetAndWriteTo(key, w)
 		if hit {
 			return
@@ -29,7 +36,7 @@ func NewCache(cache *app.LruCache, next http.Handler) http.Handler {
 
 		body, _ := ioutil.ReadAll(result.Body)
 
-		if result.StatusCode == 200 {
+		if result.StatusCode == 200 && httpserver.Storable(result.Header) {
 			err := cache.Save(key, result.Header, body)
 			if err != nil {
 				log.Println(err)
@@ -0,0 +1,76 @@
+package httpserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// OptionProgressive progressive JPEG: progressive:1 or progressive:0.
+	OptionProgressive = "progressive"
+	// OptionPalette PNG palette quantization: palette:<colors>, palette:0 keeps full color.
+	OptionPalette = "palette"
+	// OptionMaxBytes target file size of JPEG: max_bytes:<bytes>.
+	OptionMaxBytes = "max_bytes"
+
+	maxPaletteColors = 256
+)
+
+// optionParsers parsers of the option segments placed between the size and the image URL.
+var optionParsers = map[string]func(value string, opts *ResizeOptions) error{
+	OptionProgressive: func(value string, opts *ResizeOptions) error {
+		progressive, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("option `%s` must be 1 or 0", OptionProgressive)
+		}
+		opts.Progressive = progressive
+		return nil
+	},
+	OptionPalette: func(value string, opts *ResizeOptions) error {
+		colors, err := strconv.Atoi(value)
+		if err != nil || colors < 0 || colors == 1 || colors > maxPaletteColors {
+			return fmt.Errorf("option `%s` must be 0 or number of colors from 2 to %d", OptionPalette, maxPaletteColors)
+		}
+		opts.Palette = colors
+		return nil
+	},
+	OptionMaxBytes: func(value string, opts *ResizeOptions) error {
+		maxBytes, err := strconv.Atoi(value)
+		if err != nil || maxBytes < 0 {
+			return fmt.Errorf("option `%s` must be a non-negative integer", OptionMaxBytes)
+		}
+		opts.MaxBytes = maxBytes
+		return nil
+	},
+}
+
+// WithDefaults sets the options used when the request does not specify them.
+func WithDefaults(defaults ResizeOptions) HandlerOption {
+	return func(h *Handler) {
+		h.defaults = defaults
+	}
+}
+
+// parseOptions applies the leading <name>:<value> segments to opts and returns the rest of the URI.
+func parseOptions(uri string, opts *ResizeOptions) (string, error) {
+	for {
+		segment, next := uri, ""
+		if i := strings.IndexByte(uri, '/'); i >= 0 {
+			segment, next = uri[:i], uri[i+1:]
+		}
+		i := strings.IndexByte(segment, ':')
+		if i < 0 {
+			return uri, nil
+		}
+		parse, ok := optionParsers[segment[:i]]
+		if !ok {
+			// not an option, the image URL starts here
+			return uri, nil
+		}
+		if err := parse(segment[i+1:], opts); err != nil {
+			return "", err
+		}
+		uri = next
+	}
+}
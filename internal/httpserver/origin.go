@@ -0,0 +1,43 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// OriginScheme the scheme of the image URLs on the configured origins passed to the downloader:
+	// origin://<name>/<path>.
+	OriginScheme = "origin"
+
+	// originPrefix the prefix of the image on the configured origin in the request URL: @<name>/<path>.
+	originPrefix = "@"
+)
+
+// WithOrigins allows the @<name>/<path> images on the named origins,
+// they are passed to the downloader as origin://<name>/<path>, so the origin hosts are not exposed in the URLs.
+func WithOrigins(names ...string) HandlerOption {
+	return func(h *Handler) {
+		if h.origins == nil {
+			h.origins = make(map[string]bool, len(names))
+		}
+		for _, name := range names {
+			h.origins[name] = true
+		}
+	}
+}
+
+// resolveOrigin converts @<name>/<path> to origin://<name>/<path>.
+func (h Handler) resolveOrigin(src string) (string, error) {
+	src = strings.TrimPrefix(src, originPrefix)
+	i := strings.IndexByte(src, '/')
+	if i <= 0 || i == len(src)-1 {
+		return "", errors.New("image URL should look like @<origin>/<path>")
+	}
+	name := src[:i]
+	if !h.origins[name] {
+		return "", fmt.Errorf("unknown origin: %s", name)
+	}
+	return OriginScheme + "://" + src, nil
+}
@@ -0,0 +1,78 @@
+package httpserver
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOriginSource(t *testing.T) {
+	h := NewHandler(nil, nil, WithOrigins("products", "media")).(Handler)
+
+	tests := []struct {
+		name string
+		uri  string
+		srcs []string
+		err  bool
+	}{
+		{name: "resize", uri: "/fill/300/200/@products/sku123.jpg", srcs: []string{"origin://products/sku123.jpg"}},
+		{
+			name: "resize with options",
+			uri:  "/fill/300/200/palette:16/@products/a/b.png",
+			srcs: []string{"origin://products/a/b.png"},
+		},
+		{
+			name: "resize plain",
+			uri:  "/fill/300/200/plain/" + url.PathEscape("@products/a.jpg?v=1"),
+			srcs: []string{"origin://products/a.jpg?v=1"},
+		},
+		{name: "resize scheme", uri: "/fill/300/200/origin://products/a.jpg", srcs: []string{"origin://products/a.jpg"}},
+		{name: "unknown origin", uri: "/fill/300/200/@other/a.jpg", err: true},
+		{name: "unknown origin scheme", uri: "/fill/300/200/origin://other/a.jpg", err: true},
+		{name: "no path", uri: "/fill/300/200/@products/", err: true},
+		{name: "no name", uri: "/fill/300/200/@/a.jpg", err: true},
+		{name: "hash", uri: "/hash/@media/a.jpg", srcs: []string{"origin://media/a.jpg"}},
+		{
+			name: "compare origins",
+			uri:  "/hash/compare/@products/a.jpg/@media/b.jpg",
+			srcs: []string{"origin://products/a.jpg", "origin://media/b.jpg"},
+		},
+		{
+			name: "compare origin and URL",
+			uri:  "/hash/compare/@products/a.jpg/https://example.com/b.jpg",
+			srcs: []string{"origin://products/a.jpg", "https://example.com/b.jpg"},
+		},
+		{
+			name: "compare URL and plain origin",
+			uri:  "/hash/compare/https://example.com/@user/b.jpg/plain/" + url.PathEscape("@media/a.jpg"),
+			srcs: []string{"https://example.com/@user/b.jpg", "origin://media/a.jpg"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var srcs []string
+			var err error
+			if strings.HasPrefix(tt.uri, "/hash/") {
+				srcs, err = h.parseHashURI(tt.uri)
+			} else {
+				var src string
+				src, _, err = h.parseRequestURI(tt.uri)
+				srcs = []string{src}
+			}
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.srcs, srcs)
+		})
+	}
+
+	// the origins must be configured
+	_, _, err := NewHandler(nil, nil).(Handler).parseRequestURI("/fill/300/200/@products/sku123.jpg")
+	require.EqualError(t, err, "unknown origin: products")
+}
@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PlaceholderHeader marks the placeholder served instead of the unavailable image.
+const PlaceholderHeader = "X-Minipic-Placeholder"
+
+type placeholder struct {
+	image []byte
+	ttl   time.Duration
+}
+
+// WithPlaceholder serves the image resized with the requested options instead of the source image
+// which is missing or whose host is unavailable.
+// The placeholder may be cached for ttl only, so that the source image appears when it is available again.
+func WithPlaceholder(image []byte, ttl time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.placeholder = placeholder{image: image, ttl: ttl}
+	}
+}
+
+// replaceable reports whether the placeholder is served instead of the image which failed to download
+// with the error or the status: the image is missing or its host is unavailable.
+// The images rejected by the service, e.g. of the forbidden address or too large, are reported to the client.
+func replaceable(err error, status int) bool {
+	if err == nil {
+		return status == http.StatusNotFound || status == http.StatusGone || status >= 500
+	}
+	if errors.Is(err, ErrForbiddenAddress) || errors.Is(err, ErrSourceTooLarge) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.Is(err, ErrSourceUnavailable) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &opErr) || errors.As(err, &dnsErr)
+}
+
+// servePlaceholder writes the resized placeholder, it returns false if the placeholder is not configured.
+func (h Handler) servePlaceholder(w http.ResponseWriter, opts ResizeOptions, expires time.Time) bool {
+	if h.placeholder.image == nil {
+		return false
+	}
+
+	ttl := h.placeholder.ttl
+	cacheControl := "public"
+	if !expires.IsZero() {
+		cacheControl = "private"
+		if until := time.Until(expires); until < ttl {
+			ttl = until
+		}
+	}
+	w.Header().Set("Cache-Control", cacheControl+", max-age="+strconv.Itoa(int(ttl.Seconds())))
+	w.Header().Set(PlaceholderHeader, "true")
+	h.resize(w, bytes.NewReader(h.placeholder.image), opts, http.StatusInternalServerError)
+	return true
+}
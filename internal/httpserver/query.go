@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// queryPath the path of the query string API: /resize?url=<image_url>&w=<width>&h=<height>&mode=<mode>.
+	queryPath = "/resize"
+
+	queryURL    = "url"
+	queryWidth  = "w"
+	queryHeight = "h"
+	queryMode   = "mode"
+)
+
+func isQueryURI(uri string) bool {
+	return uri == queryPath || strings.HasPrefix(uri, queryPath+"?")
+}
+
+// parseQueryURI parses the query string API request, the options have the same names as in the path API.
+func (h Handler) parseQueryURI(uri string) (src string, opts ResizeOptions, err error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return
+	}
+	query := u.Query()
+	if query.Get(queryURL) == "" || query.Get(queryWidth) == "" || query.Get(queryHeight) == "" {
+		err = errors.New(
+			"request URL should look like /resize?url=<image_url>&w=<width>&h=<height>[&mode=<mode>][&<option>=<value>]",
+		)
+		return
+	}
+
+	mode := query.Get(queryMode)
+	if mode == "" {
+		mode = ResizeModeFit
+	}
+	opts, err = h.sizeOptions(mode, query.Get(queryWidth), query.Get(queryHeight))
+	if err != nil {
+		return
+	}
+	for name, parse := range optionParsers {
+		if _, ok := query[name]; !ok {
+			continue
+		}
+		if err = parse(query.Get(name), &opts); err != nil {
+			return
+		}
+	}
+
+	src, err = h.parseSource(query.Get(queryURL))
+	return
+}
+
+// CacheKey returns the key of the response to the request in the cache.
+// The parameters of the query string API are sorted, so the equivalent requests share the key.
+func CacheKey(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if !isQueryPath(path) {
+		return r.URL.RequestURI()
+	}
+	return path + "?" + r.URL.Query().Encode()
+}
+
+// isQueryPath reports whether the path is /resize, /<signature>/resize or /<signature>/exp:<timestamp>/resize.
+func isQueryPath(path string) bool {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch len(segments) {
+	case 1, 2:
+	case 3:
+		if !strings.HasPrefix(segments[1], expiresPrefix) {
+			return false
+		}
+	default:
+		return false
+	}
+	return "/"+segments[len(segments)-1] == queryPath
+}
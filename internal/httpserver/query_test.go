@@ -0,0 +1,97 @@
+package httpserver
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueryURI(t *testing.T) {
+	h := NewHandler(nil, nil, WithDefaults(ResizeOptions{Progressive: true})).(Handler)
+
+	tests := []struct {
+		name string
+		uri  string
+		src  string
+		opts ResizeOptions
+		err  bool
+	}{
+		{
+			name: "default mode",
+			uri:  "/resize?url=https://example.com/image.jpeg&w=300&h=200",
+			src:  "https://example.com/image.jpeg",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 300, Height: 200, Progressive: true},
+		},
+		{
+			name: "escaped url with query",
+			uri:  "/resize?mode=fill&h=200&w=300&url=https%3A%2F%2Fexample.com%2Fimage.jpeg%3Fv%3D1%26s%3D2",
+			src:  "https://example.com/image.jpeg?v=1&s=2",
+			opts: ResizeOptions{Mode: ResizeModeFill, Width: 300, Height: 200, Progressive: true},
+		},
+		{
+			name: "options",
+			uri:  "/resize?url=https://example.com/image.png&w=300&h=200&progressive=0&palette=16&max_bytes=1000",
+			src:  "https://example.com/image.png",
+			opts: ResizeOptions{Mode: ResizeModeFit, Width: 300, Height: 200, Palette: 16, MaxBytes: 1000},
+		},
+		{name: "no url", uri: "/resize?w=300&h=200", err: true},
+		{name: "no size", uri: "/resize?url=https://example.com/image.jpeg&w=300", err: true},
+		{name: "invalid mode", uri: "/resize?url=https://example.com/image.jpeg&w=300&h=200&mode=crop", err: true},
+		{name: "small size", uri: "/resize?url=https://example.com/image.jpeg&w=5&h=200", err: true},
+		{name: "invalid option", uri: "/resize?url=https://example.com/image.jpeg&w=300&h=200&palette=1", err: true},
+		{name: "relative url", uri: "/resize?url=/image.jpeg&w=300&h=200", err: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			require.True(t, isQueryURI(tt.uri))
+			src, opts, err := h.parseQueryURI(tt.uri)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.src, src)
+			require.Equal(t, tt.opts, opts)
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		name string
+		uris []string
+	}{
+		{
+			name: "query API",
+			uris: []string{
+				"/resize?url=https://example.com/image.jpeg&w=300&h=200",
+				"/resize?h=200&w=300&url=https%3A%2F%2Fexample.com%2Fimage.jpeg",
+			},
+		},
+		{
+			name: "signed query API",
+			uris: []string{
+				"/sig/resize?url=https://example.com/image.jpeg&w=300&h=200",
+				"/sig/resize?w=300&h=200&url=https://example.com/image.jpeg",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			first := CacheKey(httptest.NewRequest("GET", tt.uris[0], nil))
+			for _, uri := range tt.uris[1:] {
+				require.Equal(t, first, CacheKey(httptest.NewRequest("GET", uri, nil)))
+			}
+		})
+	}
+
+	// the query of the image URL is sent to the image host as is
+	uri := "/fit/300/200/https://example.com/image.jpeg?b=1&a=2"
+	require.Equal(t, uri, CacheKey(httptest.NewRequest("GET", uri, nil)))
+	uri = "/fit/300/200/https://example.com/resize?b=1&a=2"
+	require.Equal(t, uri, CacheKey(httptest.NewRequest("GET", uri, nil)))
+}
@@ -0,0 +1,138 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// unsafeSignature the signature segment which skips the verification in the unsafe mode.
+	unsafeSignature = "unsafe"
+	// expiresPrefix the optional segment exp:<unix timestamp> which follows the signature segment.
+	expiresPrefix = "exp:"
+)
+
+var (
+	// ErrInvalidSignature the request URL is not signed by any of the keys.
+	ErrInvalidSignature = errors.New("invalid URL signature")
+	// ErrExpiredSignature the signed request URL has expired.
+	ErrExpiredSignature = errors.New("signed URL has expired")
+)
+
+type signature struct {
+	keys   map[string][]byte
+	unsafe bool
+	now    func() time.Time
+}
+
+// WithSignature requires the request URL to start with the signature segment: /[<key_id>.]<signature>/<mode>/...
+// The signature without the key ID is checked with every key,
+// so the keys can be rotated without breaking the issued URLs.
+// The unsafe mode additionally accepts /unsafe/<mode>/... without a signature and is intended for development.
+func WithSignature(keys map[string]string, unsafe bool) HandlerOption {
+	return func(h *Handler) {
+		h.signature = signature{keys: make(map[string][]byte, len(keys)), unsafe: unsafe, now: time.Now}
+		for id, key := range keys {
+			h.signature.keys[id] = []byte(key)
+		}
+	}
+}
+
+// Sign returns the URL-safe base64 HMAC-SHA256 signature of the request URI which follows the signature segment,
+// e.g. of /fill/300/200/https://example.com/image.jpeg or /exp:1700000000/fill/300/200/https://example.com/image.jpeg.
+func Sign(key []byte, uri string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uri))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s signature) enabled() bool {
+	return len(s.keys) > 0 || s.unsafe
+}
+
+// verify checks the signature and expiry segments and returns the request URI without them
+// and the expiry time of the URL (zero if the URL does not expire).
+func (s signature) verify(uri string) (string, time.Time, error) {
+	if !s.enabled() {
+		return uri, time.Time{}, nil
+	}
+
+	sig, rest := splitSegment(uri)
+	if rest == "" {
+		return "", time.Time{}, errors.New(
+			"request URL should look like /<signature>/[exp:<timestamp>/]<mode>/<width>/<height>/<image_url>",
+		)
+	}
+
+	if !(s.unsafe && sig == unsafeSignature) && !s.valid(sig, rest) {
+		return "", time.Time{}, ErrInvalidSignature
+	}
+
+	segment, next := splitSegment(rest)
+	if !strings.HasPrefix(segment, expiresPrefix) {
+		return rest, time.Time{}, nil
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimPrefix(segment, expiresPrefix), 10, 64)
+	if err != nil {
+		return "", time.Time{}, errors.New("expiry segment must look like exp:<unix timestamp>")
+	}
+	expires := time.Unix(timestamp, 0)
+	if !s.now().Before(expires) {
+		return "", time.Time{}, fmt.Errorf("%w at %s", ErrExpiredSignature, expires.UTC().Format(time.RFC3339))
+	}
+	return next, expires, nil
+}
+
+// resign returns the given request URI with the signature of the same form (key, expiry)
+// as of the verified request URI.
+func (s signature) resign(requestURI, uri string) string {
+	if !s.enabled() {
+		return uri
+	}
+
+	sig, rest := splitSegment(requestURI)
+	if segment, _ := splitSegment(rest); strings.HasPrefix(segment, expiresPrefix) {
+		uri = "/" + segment + uri
+	}
+	if s.unsafe && sig == unsafeSignature {
+		return "/" + unsafeSignature + uri
+	}
+	if i := strings.IndexByte(sig, '.'); i >= 0 {
+		return "/" + sig[:i+1] + Sign(s.keys[sig[:i]], uri) + uri
+	}
+	for _, key := range s.keys {
+		if hmac.Equal([]byte(sig), []byte(Sign(key, rest))) {
+			return "/" + Sign(key, uri) + uri
+		}
+	}
+	return uri
+}
+
+// valid checks the signature with the key given by ID or, without the ID, with all keys.
+func (s signature) valid(sig, uri string) bool {
+	if i := strings.IndexByte(sig, '.'); i >= 0 {
+		key, ok := s.keys[sig[:i]]
+		return ok && hmac.Equal([]byte(sig[i+1:]), []byte(Sign(key, uri)))
+	}
+	for _, key := range s.keys {
+		if hmac.Equal([]byte(sig), []byte(Sign(key, uri))) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSegment splits /<segment>/<rest> into <segment> and /<rest>.
+func splitSegment(uri string) (string, string) {
+	segment := strings.TrimPrefix(uri, "/")
+	if i := strings.IndexByte(segment, '/'); i >= 0 {
+		return segment[:i], segment[i:]
+	}
+	return segment, ""
+}
@@ -0,0 +1,217 @@
+package httpserver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	// sourceBase64 the prefix of the image URL encoded with URL-safe base64.
+	sourceBase64 = "b64/"
+	// sourcePlain the prefix of the percent-encoded image URL.
+	sourcePlain = "plain/"
+)
+
+// ErrSourceForbidden the image URL is rejected by the source policy.
+var ErrSourceForbidden = errors.New("image URL is not allowed")
+
+// SourcePolicy restricts the image URLs which may be downloaded.
+// A pattern containing "://" is a URL prefix: the scheme, the host and the port must be equal
+// and the cleaned path of the image URL must be the pattern path or lie under it.
+// Otherwise it is a host pattern with the wildcards of path.Match, e.g. "*.example.com", matching any port.
+type SourcePolicy struct {
+	// Allow when not empty, only the matching URLs are allowed.
+	Allow []string
+	// Deny the matching URLs are forbidden even if they are allowed.
+	Deny []string
+}
+
+// sourcePattern the parsed pattern of the SourcePolicy.
+type sourcePattern struct {
+	// scheme is empty for the host pattern.
+	scheme string
+	host   string
+	port   string
+	path   string
+}
+
+// sourceRules the parsed SourcePolicy, an invalid policy forbids every image URL.
+type sourceRules struct {
+	allow []sourcePattern
+	deny  []sourcePattern
+	err   error
+}
+
+// WithSourcePolicy restricts the image URLs which may be downloaded.
+func WithSourcePolicy(policy SourcePolicy) HandlerOption {
+	return func(h *Handler) {
+		h.sources = policy.parse()
+	}
+}
+
+// Validate checks syntax of the patterns.
+func (p SourcePolicy) Validate() error {
+	return p.parse().err
+}
+
+func (p SourcePolicy) parse() sourceRules {
+	var rules sourceRules
+	rules.allow, rules.err = parseSourcePatterns(p.Allow)
+	if rules.err != nil {
+		return rules
+	}
+	rules.deny, rules.err = parseSourcePatterns(p.Deny)
+	return rules
+}
+
+func parseSourcePatterns(patterns []string) ([]sourcePattern, error) {
+	parsed := make([]sourcePattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "://") {
+			host := normalizeHost(pattern)
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("invalid source pattern %q: %w", pattern, err)
+			}
+			parsed = append(parsed, sourcePattern{host: host})
+			continue
+		}
+		u, err := url.Parse(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source pattern %q: %w", pattern, err)
+		}
+		web := u.Scheme == "http" || u.Scheme == "https"
+		if (web && u.Host == "") || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("invalid source pattern %q: must be <scheme>://<host>[:<port>][/<path>]", pattern)
+		}
+		parsed = append(parsed, sourcePattern{
+			scheme: u.Scheme,
+			host:   normalizeHost(u.Hostname()),
+			port:   normalizePort(u),
+			path:   cleanPath(u.Path),
+		})
+	}
+	return parsed, nil
+}
+
+func (r sourceRules) check(u *url.URL) error {
+	if r.err != nil {
+		return fmt.Errorf("%w: %v", ErrSourceForbidden, r.err)
+	}
+	if len(r.allow) == 0 && len(r.deny) == 0 {
+		return nil
+	}
+	// the credentials in the URL can hide the host from a reader of the URL
+	if u.User != nil {
+		return fmt.Errorf("%w: image URL must not contain credentials", ErrSourceForbidden)
+	}
+	for _, pattern := range r.deny {
+		if pattern.match(u) {
+			return fmt.Errorf("%w: %s is denied", ErrSourceForbidden, u.Host)
+		}
+	}
+	if len(r.allow) == 0 {
+		return nil
+	}
+	for _, pattern := range r.allow {
+		if pattern.match(u) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not in the allowed sources", ErrSourceForbidden, u.Host)
+}
+
+func (p sourcePattern) match(u *url.URL) bool {
+	host := normalizeHost(u.Hostname())
+	if p.scheme == "" {
+		matched, _ := path.Match(p.host, host)
+		return matched
+	}
+	if p.scheme != u.Scheme || p.host != host || p.port != normalizePort(u) {
+		return false
+	}
+	if p.path == "/" {
+		return true
+	}
+	imagePath := cleanPath(u.Path)
+	return imagePath == p.path || strings.HasPrefix(imagePath, p.path+"/")
+}
+
+// normalizeHost lowercases the host and removes the trailing dot of the fully qualified name.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// normalizePort returns the port of the URL, the default port of http and https is empty.
+func normalizePort(u *url.URL) string {
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		return ""
+	}
+	return port
+}
+
+// cleanPath resolves the dot segments of the path, so the path can not escape the prefix of the pattern.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// decodeSource decodes the image URL given as b64/<base64url> or plain/<percent-encoded>,
+// the encoded forms keep ?, # and %2F of the image URL intact.
+func decodeSource(src string) (string, error) {
+	switch {
+	case strings.HasPrefix(src, sourceBase64):
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(src, sourceBase64), "="))
+		if err != nil {
+			return "", errors.New("image URL must be encoded with URL-safe base64")
+		}
+		return string(decoded), nil
+	case strings.HasPrefix(src, sourcePlain):
+		decoded, err := url.PathUnescape(strings.TrimPrefix(src, sourcePlain))
+		if err != nil {
+			return "", errors.New("image URL must be percent-encoded")
+		}
+		return decoded, nil
+	}
+	return src, nil
+}
+
+// splitSources splits the first image URL from the rest of the URI.
+// The encoded image URL is a single segment, the URL given as is ends where the next image URL begins.
+func splitSources(uri string) (string, string, bool) {
+	for _, prefix := range []string{sourceBase64, sourcePlain} {
+		if strings.HasPrefix(uri, prefix) {
+			i := strings.IndexByte(uri[len(prefix):], '/')
+			if i < 0 {
+				return "", "", false
+			}
+			return uri[:len(prefix)+i], uri[len(prefix)+i+1:], true
+		}
+	}
+	split := -1
+	boundaries := []string{"/http://", "/https://"}
+	// the path of the image on the origin can not contain the image URL, but the path of the http(s) URL can contain "/@"
+	if strings.HasPrefix(uri, originPrefix) {
+		boundaries = append(boundaries, "/"+originPrefix)
+	}
+	for _, scheme := range boundaries {
+		if i := strings.Index(uri, scheme); i > 0 && (split < 0 || i < split) {
+			split = i
+		}
+	}
+	// the encoded second URL is the last segment, the first URL may contain the same words in its path
+	if split < 0 {
+		if i := strings.LastIndexByte(uri, '/'); i > 0 {
+			if j := strings.LastIndexByte(uri[:i], '/'); j > 0 && (uri[j+1:i+1] == sourceBase64 || uri[j+1:i+1] == sourcePlain) {
+				split = j
+			}
+		}
+	}
+	if split < 0 {
+		return "", "", false
+	}
+	return uri[:split], uri[split+1:], true
+}
@@ -0,0 +1,169 @@
+package httpserver
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourcePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  SourcePolicy
+		src     string
+		allowed bool
+	}{
+		{
+			name:    "no rules",
+			policy:  SourcePolicy{},
+			src:     "https://x@example.com/a.jpg",
+			allowed: true,
+		},
+		{
+			name:    "allowed scheme",
+			policy:  SourcePolicy{Allow: []string{"local://"}},
+			src:     "local:///images/a.jpg",
+			allowed: true,
+		},
+		{
+			name:    "allowed host",
+			policy:  SourcePolicy{Allow: []string{"*.example.com"}},
+			src:     "https://cdn.example.com/a.jpg",
+			allowed: true,
+		},
+		{
+			name:    "allowed host with trailing dot",
+			policy:  SourcePolicy{Allow: []string{"cdn.example.com"}},
+			src:     "https://CDN.example.com./a.jpg",
+			allowed: true,
+		},
+		{
+			name:   "not allowed host",
+			policy: SourcePolicy{Allow: []string{"*.example.com"}},
+			src:    "https://example.net/a.jpg",
+		},
+		{
+			name:    "allowed prefix",
+			policy:  SourcePolicy{Allow: []string{"https://cdn.example.com/public/"}},
+			src:     "https://cdn.example.com/public/a.jpg",
+			allowed: true,
+		},
+		{
+			name:    "allowed prefix without slash",
+			policy:  SourcePolicy{Allow: []string{"https://cdn.example.com/public"}},
+			src:     "https://cdn.example.com/public/a.jpg",
+			allowed: true,
+		},
+		{
+			name:    "allowed default port",
+			policy:  SourcePolicy{Allow: []string{"https://cdn.example.com"}},
+			src:     "https://cdn.example.com:443/a.jpg",
+			allowed: true,
+		},
+		{
+			name:   "prefix of host",
+			policy: SourcePolicy{Allow: []string{"https://cdn.example.com"}},
+			src:    "https://cdn.example.com.attacker.net/a.jpg",
+		},
+		{
+			name:   "prefix of path segment",
+			policy: SourcePolicy{Allow: []string{"https://cdn.example.com/public"}},
+			src:    "https://cdn.example.com/publicity/a.jpg",
+		},
+		{
+			name:   "dot segments",
+			policy: SourcePolicy{Allow: []string{"https://cdn.example.com/public/"}},
+			src:    "https://cdn.example.com/public/../private/a.jpg",
+		},
+		{
+			name:   "encoded dot segments",
+			policy: SourcePolicy{Allow: []string{"https://cdn.example.com/public/"}},
+			src:    "https://cdn.example.com/public/%2e%2e/private/a.jpg",
+		},
+		{
+			name:   "other scheme",
+			policy: SourcePolicy{Allow: []string{"https://cdn.example.com"}},
+			src:    "http://cdn.example.com/a.jpg",
+		},
+		{
+			name:   "other port",
+			policy: SourcePolicy{Allow: []string{"https://cdn.example.com"}},
+			src:    "https://cdn.example.com:8443/a.jpg",
+		},
+		{
+			name:   "allowed with userinfo",
+			policy: SourcePolicy{Allow: []string{"https://cdn.example.com"}},
+			src:    "https://x@cdn.example.com/a.jpg",
+		},
+		{
+			name:   "denied host",
+			policy: SourcePolicy{Deny: []string{"evil.com"}},
+			src:    "https://evil.com/a.jpg",
+		},
+		{
+			name:   "denied host with trailing dot",
+			policy: SourcePolicy{Deny: []string{"evil.com"}},
+			src:    "https://evil.com./a.jpg",
+		},
+		{
+			name:   "denied host with port",
+			policy: SourcePolicy{Deny: []string{"bad.com"}},
+			src:    "https://bad.com:443/a.jpg",
+		},
+		{
+			name:   "denied host with userinfo",
+			policy: SourcePolicy{Deny: []string{"bad.com"}},
+			src:    "https://x@bad.com/a.jpg",
+		},
+		{
+			name:   "denied prefix with default port",
+			policy: SourcePolicy{Deny: []string{"https://bad.com/"}},
+			src:    "https://bad.com:443/a.jpg",
+		},
+		{
+			name:   "denied prefix with trailing dot",
+			policy: SourcePolicy{Deny: []string{"https://bad.com/"}},
+			src:    "https://BAD.com./a.jpg",
+		},
+		{
+			name:    "not denied host",
+			policy:  SourcePolicy{Deny: []string{"bad.com"}},
+			src:     "https://good.com/a.jpg",
+			allowed: true,
+		},
+		{
+			name:   "allowed and denied",
+			policy: SourcePolicy{Allow: []string{"*.example.com"}, Deny: []string{"https://cdn.example.com/private"}},
+			src:    "https://cdn.example.com/private/a.jpg",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.policy.Validate())
+			u, err := url.Parse(tt.src)
+			require.NoError(t, err)
+
+			err = tt.policy.parse().check(u)
+			if tt.allowed {
+				require.NoError(t, err)
+				return
+			}
+			require.True(t, errors.Is(err, ErrSourceForbidden), err)
+		})
+	}
+}
+
+func TestSourcePolicyValidate(t *testing.T) {
+	patterns := []string{"[a-", "https://", "https://user@example.com/", "https://example.com/?a=1", "https://%zz/"}
+	for _, pattern := range patterns {
+		policy := SourcePolicy{Deny: []string{pattern}}
+		require.Error(t, policy.Validate(), pattern)
+
+		u, err := url.Parse("https://example.com/a.jpg")
+		require.NoError(t, err)
+		require.True(t, errors.Is(policy.parse().check(u), ErrSourceForbidden), pattern)
+	}
+}
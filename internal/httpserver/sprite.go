@@ -0,0 +1,267 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// spritePath the path of the sprite API: /sprite?w=<width>&h=<height>&cols=<columns>&url=<image_url>&url=...
+	spritePath = "/sprite"
+	// maxSpriteTiles the maximum number of images in the sprite.
+	maxSpriteTiles = 100
+	// maxSpritePixels the maximum resolution of the sprite, the canvas is allocated before the images are resized.
+	maxSpritePixels = 4096 * 4096
+	// maxSpriteBytes the maximum total size of the images of the sprite, they are kept in memory until composed.
+	maxSpriteBytes = 64 << 20
+	// spriteWorkers the number of the images of the sprite downloaded at once.
+	spriteWorkers = 8
+
+	queryColumns = "cols"
+	queryFormat  = "format"
+)
+
+// SpriteOptions the grid of the sprite.
+type SpriteOptions struct {
+	TileWidth  int
+	TileHeight int
+	Columns    int
+	// Format image format of the sprite: jpeg or png.
+	Format string
+}
+
+// SpriteComposer resizes the images with the fill mode and tiles them into a grid row by row.
+// The tile of a nil source is left empty, the errors of the sources which can not be resized are returned by index.
+type SpriteComposer interface {
+	Compose(srcs []io.Reader, dst io.Writer, opts SpriteOptions) ([]error, error)
+}
+
+type spriteTile struct {
+	URL    string `json:"url"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Error  string `json:"error,omitempty"`
+}
+
+type spriteResponse struct {
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Tiles  []spriteTile `json:"tiles"`
+}
+
+func isSpriteURI(uri string) bool {
+	return uri == spritePath || strings.HasPrefix(uri, spritePath+"?")
+}
+
+// serveSprite serves the multipart response with the JSON map of the tiles and the sprite image.
+func (h Handler) serveSprite(w http.ResponseWriter, r *http.Request, uri string) {
+	composer, ok := h.resizer.(SpriteComposer)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	srcs, opts, err := h.parseSpriteURI(uri)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	ctx, cancel := h.downloadContext(r)
+	defer cancel()
+
+	images := make([]io.Reader, len(srcs))
+	errs := make([]error, len(srcs))
+	budget := &byteBudget{remaining: maxSpriteBytes}
+	workers := make(chan struct{}, spriteWorkers)
+	var wg sync.WaitGroup
+	for i, src := range srcs {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, src string) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			data, err := h.downloadImage(ctx, src, h.requestHeaders.filter(r.Header), budget)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			images[i] = bytes.NewReader(data)
+		}(i, src)
+	}
+	wg.Wait()
+
+	var img bytes.Buffer
+	resizeErrs, err := composer.Compose(images, &img, opts)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	response := spriteResponse{Tiles: make([]spriteTile, len(srcs))}
+	failed := 0
+	for i, src := range srcs {
+		response.Tiles[i] = spriteTile{
+			URL:    src,
+			X:      i % opts.Columns * opts.TileWidth,
+			Y:      i / opts.Columns * opts.TileHeight,
+			Width:  opts.TileWidth,
+			Height: opts.TileHeight,
+		}
+		if errs[i] == nil && i < len(resizeErrs) {
+			errs[i] = resizeErrs[i]
+		}
+		if errs[i] != nil {
+			response.Tiles[i].Error = errs[i].Error()
+			failed++
+		}
+	}
+	if failed == len(srcs) {
+		http.Error(w, "no image of the sprite can be resized: "+response.Tiles[0].Error, errorStatus(errs[0]))
+		return
+	}
+	response.Width = opts.Columns * opts.TileWidth
+	response.Height = (len(srcs) + opts.Columns - 1) / opts.Columns * opts.TileHeight
+
+	tiles, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{contentType: "application/json", data: tiles},
+		{contentType: "image/" + opts.Format, data: img.Bytes()},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {part.contentType},
+			"Content-Length": {strconv.Itoa(len(part.data))},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pw.Write(part.data)
+	}
+	mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	io.Copy(w, &body)
+}
+
+// downloadImage downloads the whole image, the response with other status than 200 is an error.
+// The bytes of the image are taken from the budget shared by the images of the request.
+func (h Handler) downloadImage(
+	ctx context.Context, src string, headers http.Header, budget *byteBudget,
+) ([]byte, error) {
+	res, err := h.downloader.Download(ctx, src, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image %s responded with status %s", src, res.Status)
+	}
+	return io.ReadAll(budgetReader{reader: res.Body, budget: budget})
+}
+
+// byteBudget the number of bytes which may still be read by the budgetReaders sharing it.
+type byteBudget struct {
+	remaining int64
+}
+
+// budgetReader fails with ErrSourceTooLarge when the budget is exhausted.
+type budgetReader struct {
+	reader io.Reader
+	budget *byteBudget
+}
+
+func (r budgetReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if atomic.AddInt64(&r.budget.remaining, -int64(n)) < 0 {
+		return n, fmt.Errorf("%w: images of the sprite exceed %d bytes", ErrSourceTooLarge, maxSpriteBytes)
+	}
+	return n, err
+}
+
+func (h Handler) parseSpriteURI(uri string) (srcs []string, opts SpriteOptions, err error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return
+	}
+	query := u.Query()
+	urls := query[queryURL]
+	if len(urls) == 0 || query.Get(queryWidth) == "" || query.Get(queryHeight) == "" {
+		err = errors.New("request URL should look like " +
+			"/sprite?w=<width>&h=<height>[&cols=<columns>][&format=jpeg|png]&url=<image_url>&url=...")
+		return
+	}
+	if len(urls) > maxSpriteTiles {
+		err = fmt.Errorf("sprite must contain at most %d images", maxSpriteTiles)
+		return
+	}
+
+	size, err := h.sizeOptions(ResizeModeFill, query.Get(queryWidth), query.Get(queryHeight))
+	if err != nil {
+		return
+	}
+	opts = SpriteOptions{TileWidth: size.Width, TileHeight: size.Height, Format: "jpeg"}
+
+	// the grid is square by default
+	opts.Columns = int(math.Ceil(math.Sqrt(float64(len(urls)))))
+	if cols := query.Get(queryColumns); cols != "" {
+		opts.Columns, err = strconv.Atoi(cols)
+		if err != nil || opts.Columns < 1 {
+			err = errors.New("number of columns must be a positive integer")
+			return
+		}
+	}
+	// the float product does not overflow
+	rows := (len(urls) + opts.Columns - 1) / opts.Columns
+	pixels := float64(opts.Columns) * float64(opts.TileWidth) * float64(rows) * float64(opts.TileHeight)
+	if pixels > maxSpritePixels {
+		err = fmt.Errorf("%w: sprite exceeds %d pixels", ErrOutputResolution, maxSpritePixels)
+		return
+	}
+	if format := query.Get(queryFormat); format != "" {
+		if format != "jpeg" && format != "png" {
+			err = errors.New("sprite format must be `jpeg` or `png`")
+			return
+		}
+		opts.Format = format
+	}
+
+	for _, u := range urls {
+		var src string
+		src, err = h.parseSource(u)
+		if err != nil {
+			return
+		}
+		srcs = append(srcs, src)
+	}
+	return
+}
@@ -0,0 +1,22 @@
+package httpserver
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudgetReader(t *testing.T) {
+	budget := &byteBudget{remaining: 10}
+
+	data, err := io.ReadAll(budgetReader{reader: strings.NewReader("123456"), budget: budget})
+	require.NoError(t, err)
+	require.Equal(t, "123456", string(data))
+
+	// the budget is shared by the readers
+	_, err = io.ReadAll(budgetReader{reader: strings.NewReader("123456"), budget: budget})
+	require.True(t, errors.Is(err, ErrSourceTooLarge), err)
+}
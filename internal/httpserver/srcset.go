@@ -0,0 +1,250 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	srcsetPrefix = "srcset"
+
+	srcsetJSON    = "json"
+	srcsetImg     = "img"
+	srcsetPicture = "picture"
+
+	// srcsetAuto the aspect ratio of the source image.
+	srcsetAuto = "auto"
+)
+
+// ImageInfo the format and resolution of the image.
+type ImageInfo struct {
+	Format string
+	Width  int
+	Height int
+}
+
+type ImageInspector interface {
+	Inspect(src io.Reader) (ImageInfo, error)
+}
+
+// Srcset the settings of the responsive images endpoint.
+type Srcset struct {
+	// Breakpoints the widths of the images in the srcset.
+	Breakpoints []int
+	// Sizes the sizes attribute of the image, e.g. "(max-width: 640px) 100vw, 50vw".
+	Sizes string
+	// BaseURL the URL of the service in the image URLs, by default it is taken from the request.
+	BaseURL string
+}
+
+type srcsetCandidate struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type srcsetResponse struct {
+	Src        string            `json:"src"`
+	Srcset     string            `json:"srcset"`
+	Sizes      string            `json:"sizes,omitempty"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Type       string            `json:"type"`
+	Candidates []srcsetCandidate `json:"candidates"`
+}
+
+// WithSrcset enables the /srcset/ endpoint.
+func WithSrcset(inspector ImageInspector, srcset Srcset) HandlerOption {
+	return func(h *Handler) {
+		h.inspector = inspector
+		h.srcset = srcset
+		h.srcset.Breakpoints = append([]int(nil), srcset.Breakpoints...)
+		sort.Ints(h.srcset.Breakpoints)
+	}
+}
+
+// serveSrcset serves /srcset/<json|img|picture>/<width>:<height>|auto/[<option>:<value>/]<image_url>
+// with the URLs of the image resized to the breakpoints which do not upscale it.
+func (h Handler) serveSrcset(w http.ResponseWriter, r *http.Request, uri string) {
+	if h.inspector == nil || len(h.srcset.Breakpoints) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	format, ratio, rest, src, err := h.parseSrcsetURI(uri)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	ctx, cancel := h.downloadContext(r)
+	defer cancel()
+
+	res, err := h.downloader.Download(ctx, src, h.requestHeaders.filter(r.Header))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		http.Error(w, fmt.Sprintf("image %s responded with status %s", src, res.Status), res.StatusCode)
+		return
+	}
+
+	info, err := h.inspector.Inspect(res.Body)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	// the decoders accept a zero dimension in the image header
+	if info.Width <= 0 || info.Height <= 0 {
+		http.Error(w, fmt.Sprintf("image %s has invalid size %dx%d", src, info.Width, info.Height), http.StatusBadGateway)
+		return
+	}
+
+	base := h.srcset.BaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+		// the Host header is chosen by the client, the shared cache must not serve its URLs to others
+		w.Header().Set("Cache-Control", "private")
+	}
+	base = strings.TrimRight(base, "/")
+
+	response := srcsetResponse{Sizes: h.srcset.Sizes, Type: "image/" + info.Format}
+	for _, size := range srcsetSizes(h.srcset.Breakpoints, ratio, info) {
+		mode := ResizeModeFill
+		if ratio[0] == 0 {
+			mode = ResizeModeFit
+		}
+		path := "/" + mode + "/" + strconv.Itoa(size[0]) + "/" + strconv.Itoa(size[1]) + "/" + rest
+		response.Candidates = append(response.Candidates, srcsetCandidate{
+			URL:    base + h.signature.resign(r.URL.RequestURI(), path),
+			Width:  size[0],
+			Height: size[1],
+		})
+	}
+	candidates := make([]string, 0, len(response.Candidates))
+	for _, c := range response.Candidates {
+		candidates = append(candidates, c.URL+" "+strconv.Itoa(c.Width)+"w")
+	}
+	largest := response.Candidates[len(response.Candidates)-1]
+	response.Src, response.Width, response.Height = largest.URL, largest.Width, largest.Height
+	response.Srcset = strings.Join(candidates, ", ")
+
+	var body []byte
+	switch format {
+	case srcsetJSON:
+		body, err = json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		body = []byte(srcsetHTML(format, response))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// srcsetSizes returns the sizes of the breakpoints which do not upscale the image, ordered by width.
+// If every breakpoint upscales the image, the largest size which does not is returned,
+// the sizes are never smaller than the resize requests accept.
+func srcsetSizes(breakpoints []int, ratio [2]int, info ImageInfo) [][2]int {
+	if ratio[0] == 0 {
+		ratio = [2]int{info.Width, info.Height}
+	}
+	height := func(width int) int {
+		return (width*ratio[1] + ratio[0]/2) / ratio[0]
+	}
+
+	var sizes [][2]int
+	for _, width := range breakpoints {
+		if width > info.Width || height(width) > info.Height || width < minSize || height(width) < minSize {
+			continue
+		}
+		sizes = append(sizes, [2]int{width, height(width)})
+	}
+	if len(sizes) == 0 {
+		width := info.Width
+		if height(width) > info.Height {
+			width = info.Height * ratio[0] / ratio[1]
+		}
+		size := [2]int{width, height(width)}
+		for i := range size {
+			if size[i] < minSize {
+				size[i] = minSize
+			}
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+func srcsetHTML(format string, response srcsetResponse) string {
+	var sizes string
+	if response.Sizes != "" {
+		sizes = ` sizes="` + html.EscapeString(response.Sizes) + `"`
+	}
+	src := html.EscapeString(response.Src)
+	img := fmt.Sprintf(`<img src="%s" width="%d" height="%d"`, src, response.Width, response.Height)
+	srcset := ` srcset="` + html.EscapeString(response.Srcset) + `"` + sizes
+	if format == srcsetImg {
+		return img + srcset + `>`
+	}
+	return `<picture><source type="` + response.Type + `"` + srcset + `>` + img + `></picture>`
+}
+
+// parseSrcsetURI returns the response format, the aspect ratio (zero for auto), the options with the image URL
+// and the image URL.
+func (h Handler) parseSrcsetURI(uri string) (format string, ratio [2]int, rest string, src string, err error) {
+	params := strings.SplitN(strings.TrimPrefix(uri, "/"+srcsetPrefix+"/"), "/", 3)
+	if len(params) != 3 {
+		err = errors.New(
+			"request URL should look like /srcset/<json|img|picture>/<width>:<height>|auto/[<option>:<value>/]<image_url>",
+		)
+		return
+	}
+	format, rest = params[0], params[2]
+	if format != srcsetJSON && format != srcsetImg && format != srcsetPicture {
+		err = fmt.Errorf("srcset format must be `%s`, `%s` or `%s`", srcsetJSON, srcsetImg, srcsetPicture)
+		return
+	}
+	if params[1] != srcsetAuto {
+		parts := strings.Split(params[1], ":")
+		var w, ht int
+		if len(parts) == 2 {
+			w, err = strconv.Atoi(parts[0])
+			if err == nil {
+				ht, err = strconv.Atoi(parts[1])
+			}
+		}
+		if len(parts) != 2 || err != nil || w <= 0 || ht <= 0 {
+			err = fmt.Errorf("aspect ratio must look like <width>:<height> or `%s`", srcsetAuto)
+			return
+		}
+		ratio = [2]int{w, ht}
+	}
+
+	// the options are checked here and applied by the resize requests
+	var opts ResizeOptions
+	srcURI, err := parseOptions(rest, &opts)
+	if err != nil {
+		return
+	}
+	src, err = h.parseSource(srcURI)
+	return
+}
@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSrcsetSizes(t *testing.T) {
+	breakpoints := []int{320, 640, 1280, 1920}
+	landscape := ImageInfo{Format: "jpeg", Width: 1600, Height: 900}
+
+	tests := []struct {
+		name  string
+		ratio [2]int
+		info  ImageInfo
+		sizes [][2]int
+	}{
+		{name: "auto", info: landscape, sizes: [][2]int{{320, 180}, {640, 360}, {1280, 720}}},
+		{name: "square", ratio: [2]int{1, 1}, info: landscape, sizes: [][2]int{{320, 320}, {640, 640}}},
+		{name: "wide", ratio: [2]int{21, 9}, info: landscape, sizes: [][2]int{{320, 137}, {640, 274}, {1280, 549}}},
+		{name: "small source", ratio: [2]int{4, 3}, info: ImageInfo{Width: 200, Height: 200}, sizes: [][2]int{{200, 150}}},
+		{
+			name:  "small portrait source",
+			ratio: [2]int{1, 1},
+			info:  ImageInfo{Width: 200, Height: 100},
+			sizes: [][2]int{{100, 100}},
+		},
+		{name: "narrow ratio", ratio: [2]int{100, 1}, info: ImageInfo{Width: 200, Height: 200}, sizes: [][2]int{{200, 10}}},
+		{name: "tall ratio", ratio: [2]int{1, 100}, info: ImageInfo{Width: 200, Height: 200}, sizes: [][2]int{{10, 200}}},
+		{name: "wide source", info: ImageInfo{Width: 3000, Height: 5}, sizes: [][2]int{{3000, 10}}},
+		{name: "tiny source", info: ImageInfo{Width: 5, Height: 5}, sizes: [][2]int{{10, 10}}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sizes := srcsetSizes(breakpoints, tt.ratio, tt.info)
+			require.Equal(t, tt.sizes, sizes)
+			// every candidate is accepted by the resize request
+			for _, size := range sizes {
+				require.GreaterOrEqual(t, size[0], minSize)
+				require.GreaterOrEqual(t, size[1], minSize)
+			}
+		})
+	}
+}
+
+func TestParseSrcsetURI(t *testing.T) {
+	h := NewHandler(nil, nil).(Handler)
+
+	tests := []struct {
+		uri    string
+		format string
+		ratio  [2]int
+		rest   string
+		err    bool
+	}{
+		{
+			uri:    "/srcset/json/16:9/https://example.com/image.jpeg",
+			format: "json",
+			ratio:  [2]int{16, 9},
+			rest:   "https://example.com/image.jpeg",
+		},
+		{
+			uri:    "/srcset/img/auto/progressive:1/https://example.com/image.jpeg",
+			format: "img",
+			rest:   "progressive:1/https://example.com/image.jpeg",
+		},
+		{
+			uri:    "/srcset/picture/1:1/b64/aHR0cHM6Ly9leGFtcGxlLmNvbS9pbWFnZS5qcGVn",
+			format: "picture",
+			ratio:  [2]int{1, 1},
+			rest:   "b64/aHR0cHM6Ly9leGFtcGxlLmNvbS9pbWFnZS5qcGVn",
+		},
+		{uri: "/srcset/xml/1:1/https://example.com/image.jpeg", err: true},
+		{uri: "/srcset/json/16x9/https://example.com/image.jpeg", err: true},
+		{uri: "/srcset/json/0:9/https://example.com/image.jpeg", err: true},
+		{uri: "/srcset/json/1:1/palette:1/https://example.com/image.jpeg", err: true},
+		{uri: "/srcset/json/https://example.com/image.jpeg", err: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.uri, func(t *testing.T) {
+			format, ratio, rest, src, err := h.parseSrcsetURI(tt.uri)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.format, format)
+			require.Equal(t, tt.ratio, ratio)
+			require.Equal(t, tt.rest, rest)
+			require.Equal(t, "https://example.com/image.jpeg", src)
+		})
+	}
+}
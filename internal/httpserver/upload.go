@@ -0,0 +1,124 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// uploadFormField the name of the multipart form field with the uploaded image.
+const uploadFormField = "image"
+
+// WithUpload enables POST /<mode>/<width>/<height>/[<option>:<value>/] with the image in the body
+// or in the multipart form field "image", the body size is limited by maxSize bytes.
+func WithUpload(maxSize int64) HandlerOption {
+	return func(h *Handler) {
+		h.uploadSize = maxSize
+	}
+}
+
+func (h Handler) serveUpload(w http.ResponseWriter, r *http.Request, uri string) {
+	opts, err := h.parseUploadURI(uri)
+	if err != nil {
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	if r.ContentLength > h.uploadSize {
+		msg := fmt.Sprintf("%s: %d bytes exceeds %d", ErrSourceTooLarge, r.ContentLength, h.uploadSize)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := &limitedReader{r: r.Body, n: h.uploadSize}
+	data, err := readUpload(r, body)
+	if body.exceeded {
+		err = fmt.Errorf("%w: exceeds %d bytes", ErrSourceTooLarge, h.uploadSize)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	// the uploaded image is not an upstream response, so it is the client's fault if it can not be resized
+	h.resize(w, bytes.NewReader(data), opts, http.StatusUnprocessableEntity)
+}
+
+func (h Handler) parseUploadURI(uri string) (ResizeOptions, error) {
+	params := strings.SplitN(strings.Trim(uri, "/"), "/", 4)
+	if len(params) < 3 {
+		return ResizeOptions{}, errors.New("request URL should look like /<mode>/<width>/<height>/[<option>:<value>/]")
+	}
+	opts, err := h.sizeOptions(params[0], params[1], params[2])
+	if err != nil {
+		return ResizeOptions{}, err
+	}
+	if len(params) == 4 {
+		rest, err := parseOptions(params[3], &opts)
+		if err != nil {
+			return ResizeOptions{}, err
+		}
+		if rest != "" {
+			return ResizeOptions{}, fmt.Errorf("unknown option `%s`", rest)
+		}
+	}
+	return opts, nil
+}
+
+// readUpload reads the image from the request body or from the multipart form.
+func readUpload(r *http.Request, body io.Reader) ([]byte, error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return io.ReadAll(body)
+	}
+
+	if params["boundary"] == "" {
+		return nil, errors.New("multipart form has no boundary")
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("multipart form has no `%s` field", uploadFormField)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == uploadFormField {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// uploadErrorStatus maps the upload read error to the response status.
+func uploadErrorStatus(err error) int {
+	if errors.Is(err, ErrSourceTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// limitedReader reads at most n bytes and marks the excess instead of silently truncating the body.
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		l.exceeded = true
+		n = int(l.n)
+		err = ErrSourceTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,233 @@
+// Package client builds and signs the minipic request URLs.
+// The image is given as an absolute http(s) URL, as @<origin>/<path> or as local:///<path> and s3://<bucket>/<key>,
+// the latter are accepted by the service when the origins, the local directory or S3 are configured.
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	modeFit  = "fit"
+	modeFill = "fill"
+
+	minSize = 10
+
+	// originPrefix the prefix of the image on the origin configured in the service: @<origin>/<path>.
+	originPrefix = "@"
+	// sourcePlain the prefix of the percent-encoded image URL.
+	sourcePlain = "plain/"
+
+	localScheme = "local"
+	s3Scheme    = "s3"
+)
+
+// Builder builds the request URLs of the minipic service.
+type Builder struct {
+	base    string
+	keyID   string
+	key     []byte
+	unsafe  bool
+	expires time.Time
+}
+
+// Option configures the Builder.
+type Option func(b *Builder)
+
+// WithKey signs the URLs with the key, the key ID may be empty if the service should try all its keys.
+func WithKey(id, key string) Option {
+	return func(b *Builder) {
+		b.keyID = id
+		b.key = []byte(key)
+	}
+}
+
+// WithUnsafe adds the unsafe segment instead of the signature, it is accepted by the service in the unsafe mode only.
+func WithUnsafe() Option {
+	return func(b *Builder) {
+		b.unsafe = true
+	}
+}
+
+// New returns the Builder of the URLs of the service located at base, e.g. https://img.example.com.
+func New(base string, opts ...Option) Builder {
+	b := Builder{base: strings.TrimRight(base, "/")}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	return b
+}
+
+// Expires returns the Builder of the signed URLs which expire at the given time.
+func (b Builder) Expires(t time.Time) Builder {
+	b.expires = t
+	return b
+}
+
+// Fit returns the builder of the URL which fits the image into the given size.
+func (b Builder) Fit(width, height int) Resize {
+	return Resize{builder: b, mode: modeFit, width: width, height: height}
+}
+
+// Fill returns the builder of the URL which fills the given size with the image.
+func (b Builder) Fill(width, height int) Resize {
+	return Resize{builder: b, mode: modeFill, width: width, height: height}
+}
+
+// Hash returns the URL of the perceptual hashes of the image.
+func (b Builder) Hash(src string) (string, error) {
+	src, err := source(src)
+	if err != nil {
+		return "", err
+	}
+	return b.build("/hash/" + src)
+}
+
+// Compare returns the URL of the perceptual hashes distance between two images.
+func (b Builder) Compare(src1, src2 string) (string, error) {
+	src1, err := source(src1)
+	if err != nil {
+		return "", err
+	}
+	src2, err = source(src2)
+	if err != nil {
+		return "", err
+	}
+	// the second image which is not http(s) URL is encoded, so that the service can find where the first one ends
+	if !strings.HasPrefix(src2, "http://") && !strings.HasPrefix(src2, "https://") &&
+		!strings.HasPrefix(src2, sourcePlain) {
+		src2 = sourcePlain + url.PathEscape(src2)
+	}
+	return b.build("/hash/compare/" + src1 + "/" + src2)
+}
+
+// build adds the expiry and signature segments and the base URL to the request path.
+func (b Builder) build(path string) (string, error) {
+	if !b.expires.IsZero() {
+		if b.key == nil && !b.unsafe {
+			return "", errors.New("expiring URL must be signed")
+		}
+		path = "/exp:" + strconv.FormatInt(b.expires.Unix(), 10) + path
+	}
+	switch {
+	case b.key != nil:
+		sig := Sign(b.key, path)
+		if b.keyID != "" {
+			sig = b.keyID + "." + sig
+		}
+		path = "/" + sig + path
+	case b.unsafe:
+		path = "/unsafe" + path
+	}
+	return b.base + path, nil
+}
+
+// Sign returns the signature of the request path which follows the signature segment.
+func Sign(key []byte, path string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Resize builds the URL of the resized image.
+type Resize struct {
+	builder     Builder
+	mode        string
+	width       int
+	height      int
+	progressive *bool
+	palette     *int
+	maxBytes    *int
+}
+
+// Progressive encodes JPEG as progressive or baseline one regardless of the service defaults.
+func (r Resize) Progressive(progressive bool) Resize {
+	r.progressive = &progressive
+	return r
+}
+
+// Palette quantizes PNG to the given number of colors (2-256), 0 keeps full color.
+func (r Resize) Palette(colors int) Resize {
+	r.palette = &colors
+	return r
+}
+
+// MaxBytes lowers JPEG quality until the image fits into the given number of bytes, 0 - no limit.
+func (r Resize) MaxBytes(maxBytes int) Resize {
+	r.maxBytes = &maxBytes
+	return r
+}
+
+// URL returns the URL of the resized image src.
+func (r Resize) URL(src string) (string, error) {
+	if r.width < minSize || r.height < minSize {
+		return "", fmt.Errorf("width and height must be at least %dpx", minSize)
+	}
+	src, err := source(src)
+	if err != nil {
+		return "", err
+	}
+
+	path := "/" + r.mode + "/" + strconv.Itoa(r.width) + "/" + strconv.Itoa(r.height)
+	if r.progressive != nil {
+		path += "/progressive:" + strconv.FormatBool(*r.progressive)
+	}
+	if r.palette != nil {
+		path += "/palette:" + strconv.Itoa(*r.palette)
+	}
+	if r.maxBytes != nil {
+		path += "/max_bytes:" + strconv.Itoa(*r.maxBytes)
+	}
+	return r.builder.build(path + "/" + src)
+}
+
+// source validates the image URL or the @<origin>/<path> image
+// and escapes the characters which are not allowed in the request path.
+// The URL with a query or percent-encoded characters is fully percent-encoded to keep it intact.
+func source(src string) (string, error) {
+	if strings.HasPrefix(src, originPrefix) {
+		i := strings.IndexByte(src, '/')
+		if i <= len(originPrefix) || i == len(src)-1 {
+			return "", fmt.Errorf("image on the origin must look like @<origin>/<path>: %q", src)
+		}
+		if strings.ContainsAny(src, "?#%") {
+			return sourcePlain + url.PathEscape(src), nil
+		}
+		return src, nil
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("invalid image URL: %q", src)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return "", fmt.Errorf("image URL must be absolute http(s) URL: %q", src)
+		}
+	case localScheme:
+		if u.Host != "" || strings.Trim(u.Path, "/") == "" {
+			return "", fmt.Errorf("local image must look like local:///<path>: %q", src)
+		}
+	case s3Scheme:
+		if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return "", fmt.Errorf("image in S3 must look like s3://<bucket>/<key>: %q", src)
+		}
+	default:
+		return "", fmt.Errorf("image URL must be absolute http(s), local:// or s3:// URL: %q", src)
+	}
+	// the fragment is never sent to the image host
+	u.Fragment = ""
+	src = u.String()
+	if u.RawQuery != "" || u.ForceQuery || strings.Contains(src, "%") {
+		return sourcePlain + url.PathEscape(src), nil
+	}
+	return src, nil
+}
@@ -0,0 +1,523 @@
+package test
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bardex/minipic/internal/app"
+	"github.com/bardex/minipic/internal/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloaderMaxSize(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	info, err := os.Stat("sample.jpeg")
+	require.NoError(t, err)
+	size := info.Size()
+
+	tests := []struct {
+		name    string
+		url     string
+		maxSize int64
+		// error of Download
+		err error
+		// error while reading the body
+		readErr error
+	}{
+		{name: "no limit", url: is.URL + "/sample.jpeg", maxSize: 0},
+		{name: "exact limit", url: is.URL + "/sample.jpeg", maxSize: size},
+		{
+			name:    "content-length over limit",
+			url:     is.URL + "/sample.jpeg",
+			maxSize: size - 1,
+			err:     httpserver.ErrSourceTooLarge,
+		},
+		{name: "stream within limit", url: is.URL + "/chunked/sample.jpeg", maxSize: size},
+		{
+			name:    "stream over limit",
+			url:     is.URL + "/chunked/sample.jpeg",
+			maxSize: size - 1,
+			readErr: httpserver.ErrSourceTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			d := app.NewImageDownloader(allowLoopback(), app.WithMaxSize(tt.maxSize))
+			res, err := d.Download(ctx, tt.url, http.Header{})
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, 200, res.StatusCode)
+
+			body, err := io.ReadAll(res.Body)
+			if tt.readErr != nil {
+				require.ErrorIs(t, err, tt.readErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, size, int64(len(body)))
+		})
+	}
+}
+
+func TestDownloaderForbiddenAddresses(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(is.URL, "http://"))
+	require.NoError(t, err)
+
+	loopback, err := app.ParseNetworks([]string{"127.0.0.1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		url  string
+		opts []app.DownloaderOption
+		err  error
+	}{
+		{name: "loopback", url: is.URL + "/sample.jpeg", err: httpserver.ErrForbiddenAddress},
+		{name: "localhost", url: "http://localhost:" + port + "/sample.jpeg", err: httpserver.ErrForbiddenAddress},
+		{name: "ipv6 loopback", url: "http://[::1]:" + port + "/sample.jpeg", err: httpserver.ErrForbiddenAddress},
+		{
+			name: "ipv4-mapped loopback",
+			url:  "http://[::ffff:127.0.0.1]:" + port + "/sample.jpeg",
+			err:  httpserver.ErrForbiddenAddress,
+		},
+		{name: "cloud metadata", url: "http://169.254.169.254/latest/meta-data/", err: httpserver.ErrForbiddenAddress},
+		{name: "private network", url: "http://10.0.0.1/", err: httpserver.ErrForbiddenAddress},
+		{name: "unspecified", url: "http://0.0.0.0:" + port + "/sample.jpeg", err: httpserver.ErrForbiddenAddress},
+		{
+			name: "allowed network",
+			url:  is.URL + "/sample.jpeg",
+			opts: []app.DownloaderOption{app.WithAllowedTargets(nil, loopback)},
+		},
+		{
+			name: "allowed host",
+			url:  "http://localhost:" + port + "/sample.jpeg",
+			opts: []app.DownloaderOption{app.WithAllowedTargets([]string{"localhost"}, nil)},
+		},
+		{
+			// the redirect target is checked as well
+			name: "redirect to forbidden address",
+			url:  "http://localhost:" + port + "/redirect/sample.jpeg",
+			opts: []app.DownloaderOption{app.WithAllowedTargets([]string{"localhost"}, nil)},
+			err:  httpserver.ErrForbiddenAddress,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			res, err := app.NewImageDownloader(tt.opts...).Download(ctx, tt.url, http.Header{})
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, 200, res.StatusCode)
+		})
+	}
+}
+
+func TestLocalDownloader(t *testing.T) {
+	info, err := os.Stat("sample.jpeg")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		err    error
+	}{
+		{name: "file", url: "local:///sample.jpeg", status: 200},
+		{name: "unclean path", url: "local:///./sub/../sample.jpeg", status: 200},
+		{name: "missing file", url: "local:///missing.jpeg", status: 404},
+		{name: "directory", url: "local:///", status: 404},
+		{name: "traversal", url: "local:///../go.mod", status: 404},
+		{name: "encoded traversal", url: "local:///%2e%2e/go.mod", status: 404},
+		{name: "http", url: "http://127.0.0.1/sample.jpeg", err: errors.New("unsupported image URL scheme: http")},
+	}
+
+	d := app.SchemeDownloader{app.LocalScheme: app.NewLocalDownloader(".", app.WithMaxSize(info.Size()))}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			res, err := d.Download(ctx, tt.url, http.Header{})
+			if tt.err != nil {
+				require.EqualError(t, err, tt.err.Error())
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, tt.status, res.StatusCode)
+			if tt.status != 200 {
+				return
+			}
+
+			require.Equal(t, "image/jpeg", res.Header.Get("Content-Type"))
+			require.Equal(t, info.ModTime().UTC().Format(http.TimeFormat), res.Header.Get("Last-Modified"))
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Len(t, body, int(info.Size()))
+		})
+	}
+
+	// the limit applies to the local files too
+	small := app.NewLocalDownloader(".", app.WithMaxSize(info.Size()-1))
+	res, err := small.Download(context.Background(), "local:///sample.jpeg", http.Header{})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	_, err = io.ReadAll(res.Body)
+	require.ErrorIs(t, err, httpserver.ErrSourceTooLarge)
+}
+
+// newFakeS3 serves the path-style objects of the private bucket "originals" (access key "minio")
+// and of the public bucket "public".
+func newFakeS3() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if parts[0] == "originals" {
+			if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=minio/") ||
+				!strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date,") ||
+				r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+				http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+				return
+			}
+		} else if parts[0] != "public" || auth != "" {
+			http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+			return
+		}
+		http.ServeFile(w, r, parts[1])
+	}))
+}
+
+func TestLocalDownloaderSymlinks(t *testing.T) {
+	sample, err := filepath.Abs("sample.jpeg")
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	require.NoError(t, os.Mkdir(root, 0o755))
+	data, err := os.ReadFile(sample)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "inner.jpeg"), data, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.jpeg"), data, 0o600))
+	require.NoError(t, os.Symlink("inner.jpeg", filepath.Join(root, "link.jpeg")))
+	require.NoError(t, os.Symlink(sample, filepath.Join(root, "outside.jpeg")))
+	require.NoError(t, os.Symlink("..", filepath.Join(root, "parent")))
+	// the root may be a symlink itself
+	require.NoError(t, os.Symlink(root, filepath.Join(dir, "rootlink")))
+
+	for _, r := range []string{root, filepath.Join(dir, "rootlink")} {
+		d := app.NewLocalDownloader(r)
+		for url, status := range map[string]int{
+			"local:///inner.jpeg":         200,
+			"local:///link.jpeg":          200,
+			"local:///outside.jpeg":       404,
+			"local:///parent/secret.jpeg": 404,
+		} {
+			res, err := d.Download(context.Background(), url, http.Header{})
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, status, res.StatusCode, r+" "+url)
+		}
+	}
+}
+
+func TestOriginDownloaderRedirect(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(is.URL, "http://"))
+	require.NoError(t, err)
+
+	origins := map[string]app.Origin{"local": {Base: "http://localhost:" + port}}
+	d := app.NewOriginDownloader(origins)
+
+	// the configured origin host is trusted
+	res, err := d.Download(context.Background(), "origin://local/sample.jpeg", http.Header{})
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, 200, res.StatusCode)
+
+	// the origin redirects to 127.0.0.1, which is another host
+	_, err = d.Download(context.Background(), "origin://local/redirect/sample.jpeg", http.Header{})
+	require.ErrorIs(t, err, httpserver.ErrForbiddenAddress)
+}
+
+func TestS3Downloader(t *testing.T) {
+	s3 := newFakeS3()
+	defer s3.Close()
+
+	info, err := os.Stat("sample.jpeg")
+	require.NoError(t, err)
+
+	defaults := app.S3Bucket{Endpoint: s3.URL, PathStyle: true}
+	buckets := map[string]app.S3Bucket{
+		"originals": {Endpoint: s3.URL, PathStyle: true, AccessKey: "minio", SecretKey: "minio123"},
+		"public":    defaults,
+	}
+	newDownloader := func(anyBucket bool) app.SchemeDownloader {
+		s3 := app.NewS3Downloader(defaults, buckets, anyBucket, app.WithMaxSize(info.Size()))
+		return app.SchemeDownloader{app.S3Scheme: s3}
+	}
+
+	tests := []struct {
+		name      string
+		url       string
+		anyBucket bool
+		status    int
+		err       string
+	}{
+		{name: "private bucket", url: "s3://originals/sample.jpeg", status: 200},
+		{name: "public bucket", url: "s3://public/sample.jpeg", status: 200},
+		{name: "missing object", url: "s3://originals/missing.jpeg", status: 404},
+		{name: "unknown bucket", url: "s3://other/sample.jpeg", err: "image URL is not allowed: unknown bucket other"},
+		// the unknown bucket is requested with the default settings
+		{name: "any bucket", url: "s3://other/sample.jpeg", anyBucket: true, status: 403},
+		{name: "no key", url: "s3://originals/", err: "image URL must look like s3://<bucket>/<key>: s3://originals/"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// the client credentials are not forwarded to the storage
+			res, err := newDownloader(tt.anyBucket).Download(ctx, tt.url, http.Header{"Authorization": {"Bearer client"}})
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, tt.status, res.StatusCode)
+			if tt.status != 200 {
+				return
+			}
+			require.Equal(t, "image/jpeg", res.Header.Get("Content-Type"))
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Len(t, body, int(info.Size()))
+		})
+	}
+
+	// the limit applies to the objects too
+	small := app.NewS3Downloader(defaults, buckets, false, app.WithMaxSize(info.Size()-1))
+	_, err = small.Download(context.Background(), "s3://originals/sample.jpeg", http.Header{})
+	require.ErrorIs(t, err, httpserver.ErrSourceTooLarge)
+
+	// the unknown bucket is forbidden rather than failed
+	h := httpserver.NewHandler(newDownloader(false), app.Resizer{}, httpserver.WithSchemes(app.S3Scheme))
+	for url, status := range map[string]int{
+		"/fit/100/100/s3://originals/sample.jpeg": 200,
+		"/fit/100/100/s3://other/sample.jpeg":     403,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		require.Equal(t, status, w.Code, url)
+	}
+}
+
+func TestDownloaderRetry(t *testing.T) {
+	var attempts int32
+	// fails the requests until the attempt given in the path, e.g. /3 succeeds at the third attempt
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		switch {
+		case r.URL.Path == "/404":
+			w.WriteHeader(http.StatusNotFound)
+		case strconv.Itoa(int(n)) != strings.TrimPrefix(r.URL.Path, "/") && n < 10:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer s.Close()
+
+	policy := app.RetryPolicy{Retries: 2, Delay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond}
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		attempts int32
+	}{
+		{name: "success", path: "/1", status: 200, attempts: 1},
+		{name: "retried", path: "/3", status: 200, attempts: 3},
+		{name: "retries exhausted", path: "/4", status: 503, attempts: 3},
+		{name: "not transient", path: "/404", status: 404, attempts: 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&attempts, 0)
+			d := app.NewImageDownloader(allowLoopback(), app.WithRetry(policy))
+			res, err := d.Download(context.Background(), s.URL+tt.path, http.Header{})
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, tt.status, res.StatusCode)
+			require.Equal(t, tt.attempts, atomic.LoadInt32(&attempts))
+		})
+	}
+
+	// the open breaker fails fast without requests to the host
+	breaker := app.NewCircuitBreaker(2, time.Minute)
+	d := app.NewImageDownloader(allowLoopback(), app.WithRetry(policy), app.WithCircuitBreaker(breaker))
+	atomic.StoreInt32(&attempts, 0)
+	_, err := d.Download(context.Background(), s.URL+"/5", http.Header{})
+	require.ErrorIs(t, err, httpserver.ErrSourceUnavailable)
+	require.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+
+	_, err = d.Download(context.Background(), s.URL+"/1", http.Header{})
+	require.ErrorIs(t, err, httpserver.ErrSourceUnavailable)
+	require.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+
+	var metrics strings.Builder
+	require.NoError(t, breaker.WriteMetrics(&metrics))
+	host := strings.TrimPrefix(s.URL, "http://")
+	require.Contains(t, metrics.String(), "minipic_downloader_breaker_state{host=\""+host+"\"} 2\n")
+}
+
+func TestDownloaderClient(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+	tlsServer := httptest.NewTLSServer(is.Config.Handler)
+	defer tlsServer.Close()
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		is.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	require.NoError(t, os.WriteFile(certFile, cert, 0o600))
+	pool, err := app.LoadCertPool(certFile)
+	require.NoError(t, err)
+
+	download := func(opts app.ClientOptions, url string, headers http.Header) (*http.Response, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		d := app.NewImageDownloader(allowLoopback(), app.WithClient(opts))
+		res, err := d.Download(ctx, url, headers)
+		if err == nil {
+			res.Body.Close()
+		}
+		return res, err
+	}
+
+	t.Run("user agent", func(t *testing.T) {
+		res, err := download(app.ClientOptions{}, is.URL+"/sample.jpeg", http.Header{"User-Agent": {"browser"}})
+		require.NoError(t, err)
+		require.Equal(t, "browser", res.Header.Get("X-From-User-Agent"))
+
+		minipic := app.ClientOptions{UserAgent: "minipic"}
+		res, err = download(minipic, is.URL+"/sample.jpeg", http.Header{"User-Agent": {"browser"}})
+		require.NoError(t, err)
+		require.Equal(t, "minipic", res.Header.Get("X-From-User-Agent"))
+	})
+
+	t.Run("custom CA", func(t *testing.T) {
+		_, err := download(app.ClientOptions{}, tlsServer.URL+"/sample.jpeg", http.Header{})
+		require.Error(t, err)
+
+		res, err := download(app.ClientOptions{RootCAs: pool}, tlsServer.URL+"/sample.jpeg", http.Header{})
+		require.NoError(t, err)
+		require.Equal(t, 200, res.StatusCode)
+
+		res, err = download(app.ClientOptions{InsecureSkipVerify: true}, tlsServer.URL+"/sample.jpeg", http.Header{})
+		require.NoError(t, err)
+		require.Equal(t, 200, res.StatusCode)
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		// the proxy on the loopback is allowed, but the image hosts are checked
+		d := app.NewImageDownloader(app.WithClient(app.ClientOptions{Proxy: proxyURL}))
+		res, err := d.Download(context.Background(), "http://93.184.216.34/sample.jpeg", http.Header{})
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, 200, res.StatusCode)
+		require.Equal(t, []string{"http://93.184.216.34/sample.jpeg"}, proxied)
+
+		_, err = d.Download(context.Background(), "http://127.0.0.1/sample.jpeg", http.Header{})
+		require.ErrorIs(t, err, httpserver.ErrForbiddenAddress)
+		require.Len(t, proxied, 1)
+	})
+}
+
+func TestDownloaderHostHeaders(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(is.URL, "http://"))
+	require.NoError(t, err)
+
+	d := app.NewImageDownloader(
+		allowLoopback(),
+		app.WithHostHeaders(map[string]map[string]string{"LOCALHOST": {"X-Api-Key": "secret"}}),
+	)
+	tests := []struct {
+		name string
+		url  string
+		key  string
+	}{
+		{name: "host", url: "http://localhost:" + port + "/sample.jpeg", key: "secret"},
+		{name: "other host", url: is.URL + "/sample.jpeg"},
+		// redirects to 127.0.0.1
+		{name: "redirect to other host", url: "http://localhost:" + port + "/redirect/sample.jpeg"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			// the static header replaces the forwarded one
+			res, err := d.Download(context.Background(), tt.url, http.Header{"X-Api-Key": {"client"}})
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, 200, res.StatusCode)
+			if tt.key != "" {
+				require.Equal(t, []string{tt.key}, res.Header.Values("X-From-X-Api-Key"))
+			} else {
+				require.NotEqual(t, "secret", res.Header.Get("X-From-X-Api-Key"))
+			}
+		})
+	}
+}
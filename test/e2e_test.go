@@ -3,13 +3,22 @@ package test
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"image"
+	"image/jpeg"
 	"io"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -30,13 +39,43 @@ func newImageServer() *httptest.Server {
 		w.Header().Add("X-Name", "test-server")
 		w.Header().Add("X-Server", "cloud")
 
-		switch r.RequestURI {
+		switch r.URL.Path {
 		case "/sample.jpeg":
 			http.ServeFile(w, r, "sample.jpeg")
 		case "/sample.png":
 			http.ServeFile(w, r, "sample.png")
 		case "/sample.webp":
 			http.ServeFile(w, r, "sample.webp")
+		case "/redirect/sample.jpeg":
+			_, port, _ := net.SplitHostPort(r.Host)
+			http.Redirect(w, r, "http://127.0.0.1:"+port+"/sample.jpeg", http.StatusFound)
+		case "/chunked/sample.jpeg":
+			// streamed without Content-Length
+			data, _ := os.ReadFile("sample.jpeg")
+			w.Header().Set("Content-Type", "image/jpeg")
+			for len(data) > 0 {
+				n := 64 * 1024
+				if n > len(data) {
+					n = len(data)
+				}
+				w.Write(data[:n])
+				w.(http.Flusher).Flush()
+				data = data[n:]
+			}
+		case "/cookie/sample.jpeg":
+			http.SetCookie(w, &http.Cookie{Name: "tracking", Value: "1"})
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+			http.ServeFile(w, r, "sample.jpeg")
+		case "/private/sample.jpeg":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			http.ServeFile(w, r, "sample.jpeg")
+		case "/slow/sample.jpeg":
+			time.Sleep(time.Second)
+			http.ServeFile(w, r, "sample.jpeg")
+		case "/zero.jpeg":
+			w.Write(zeroWidthJPEG())
+		case "/403":
+			w.WriteHeader(http.StatusForbidden)
 		case "/500":
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Header().Set("x-error", "500")
@@ -49,10 +88,55 @@ func newImageServer() *httptest.Server {
 	}))
 }
 
+// zeroWidthJPEG returns the JPEG with zero width in the frame header, it is accepted by image.DecodeConfig.
+func zeroWidthJPEG() []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	data := buf.Bytes()
+	// SOF0 marker, length, precision, height, width
+	sof := bytes.Index(data, []byte{0xff, 0xc0})
+	data[sof+7], data[sof+8] = 0, 0
+	return data
+}
+
+// get makes the GET request and reads the response body.
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+	return request(t, http.MethodGet, url, nil, nil)
+}
+
+// request sends the request with the body and the headers, it returns the response and its read body.
+func request(t *testing.T, method, url string, body io.Reader, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	require.NoError(t, err)
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	var client http.Client
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, data
+}
+
+// allowLoopback lets the downloader reach the test image server, loopback addresses are forbidden by default.
+func allowLoopback() app.DownloaderOption {
+	loopback, _ := app.ParseNetworks([]string{"127.0.0.0/8", "::1"})
+	return app.WithAllowedTargets(nil, loopback)
+}
+
 func newMinipicServer() (*httptest.Server, func()) {
 	h := httpserver.NewHandler(
-		app.NewImageDownloader(),
+		app.NewImageDownloader(allowLoopback()),
 		app.Resizer{},
+		httpserver.WithHasher(app.Hasher{}),
 	)
 	cache := app.NewLruCache("/tmp", 2)
 	h = middleware.NewCache(cache, h)
@@ -68,14 +152,7 @@ func TestLocalImageServer(t *testing.T) {
 	is := newImageServer()
 	defer is.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, is.URL+"/sample.jpeg", nil)
-	require.NoError(t, err)
-	var client http.Client
-	res, err := client.Do(req)
-	require.NoError(t, err)
-	defer res.Body.Close()
+	res, imgSer := get(t, is.URL+"/sample.jpeg")
 	require.Equal(t, 200, res.StatusCode)
 
 	f, err := os.Open("sample.jpeg")
@@ -85,8 +162,6 @@ func TestLocalImageServer(t *testing.T) {
 	require.Equal(t, strconv.FormatInt(finfo.Size(), 10), res.Header.Get("Content-Length"))
 	require.Equal(t, "image/jpeg", res.Header.Get("Content-Type"))
 
-	imgSer, err := io.ReadAll(res.Body)
-	require.NoError(t, err)
 	imgLoc, err := io.ReadAll(f)
 	require.NoError(t, err)
 	require.True(t, bytes.Equal(imgSer, imgLoc))
@@ -112,6 +187,27 @@ func TestMinipicServer(t *testing.T) {
 		{url: mp.URL + "/fit/800/800/" + is.URL + "/404", status: 404, w: 800, h: 800},
 		{url: mp.URL + "/crop/800/800/" + is.URL + "/sample.png", status: 400, w: 800, h: 800},
 		{url: mp.URL + "/crop/800/800/invalid_img_url", status: 400, w: 800, h: 800},
+		{url: mp.URL + "/fill/500/500/progressive:1/" + is.URL + "/sample.jpeg", status: 200, w: 500, h: 500},
+		{url: mp.URL + "/fit/800/600/palette:128/progressive:0/" + is.URL + "/sample.png", status: 200, w: 800, h: 600},
+		{url: mp.URL + "/fit/800/600/palette:1000/" + is.URL + "/sample.png", status: 400, w: 800, h: 600},
+		{url: mp.URL + "/fit/800/800/max_bytes:40000/" + is.URL + "/sample.jpeg", status: 200, w: 800, h: 800},
+		{url: mp.URL + "/fit/800/800/max_bytes:100/" + is.URL + "/sample.jpeg", status: 422, w: 800, h: 800},
+		{
+			url:    mp.URL + "/fit/800/600/b64/" + base64.RawURLEncoding.EncodeToString([]byte(is.URL+"/sample.png?v=1#x")),
+			status: 200,
+			w:      800,
+			h:      600,
+		},
+		{url: mp.URL + "/fit/800/600/plain/" + url.PathEscape(is.URL+"/sample.png?v=%2F"), status: 200, w: 800, h: 600},
+		{url: mp.URL + "/fit/800/600/b64/!invalid!", status: 400, w: 800, h: 600},
+		{
+			url:    mp.URL + "/resize?url=" + url.QueryEscape(is.URL+"/sample.jpeg") + "&w=500&h=500&mode=fill",
+			status: 200,
+			w:      500,
+			h:      500,
+		},
+		{url: mp.URL + "/resize?w=800&h=600&url=" + is.URL + "/sample.png&palette=64", status: 200, w: 800, h: 600},
+		{url: mp.URL + "/resize?w=800&url=" + is.URL + "/sample.png", status: 400, w: 800, h: 600},
 	}
 
 	for _, tt := range tests {
@@ -120,30 +216,16 @@ func TestMinipicServer(t *testing.T) {
 		for n := 1; n <= 2; n++ {
 			n := n
 			t.Run(fmt.Sprintf("%s (%d)", tt.url, n), func(t *testing.T) {
-				ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-				defer cancel()
-
-				req, err := http.NewRequestWithContext(ctx, http.MethodGet, tt.url, nil)
-				require.NoError(t, err)
-				req.Header.Set("User-Agent", "Firefox")
-				req.Header.Set("Accept-Encoding", "gzip,deflate")
-
-				var client http.Client
-				result, err := client.Do(req)
-
-				require.NoError(t, err)
-				defer result.Body.Close()
-
+				header := http.Header{"User-Agent": {"Firefox"}, "Accept-Encoding": {"gzip,deflate"}}
+				result, body := request(t, http.MethodGet, tt.url, nil, header)
 				require.Equal(t, tt.status, result.StatusCode)
-				body, err := io.ReadAll(result.Body)
-				require.NoError(t, err)
 				require.Equal(t, strconv.Itoa(len(body)), result.Header.Get("Content-Length"))
 
 				// check proxy-headers (except bad requests)
 				if result.StatusCode != 400 {
 					require.Equal(t, "test-server", result.Header.Get("X-Name"))
-					require.Equal(t, req.Header.Get("User-Agent"), result.Header.Get("X-From-User-Agent"))
-					require.Equal(t, req.Header.Get("Accept-Encoding"), result.Header.Get("X-From-Accept-Encoding"))
+					require.Equal(t, header.Get("User-Agent"), result.Header.Get("X-From-User-Agent"))
+					require.Equal(t, header.Get("Accept-Encoding"), result.Header.Get("X-From-Accept-Encoding"))
 				}
 
 				// check image resized and cache
@@ -156,6 +238,9 @@ func TestMinipicServer(t *testing.T) {
 					}
 
 					require.Contains(t, result.Header.Get("Content-Type"), "image/")
+					if result.Header.Get("Content-Type") == "image/jpeg" {
+						require.NotEmpty(t, result.Header.Get("X-Minipic-Quality"))
+					}
 					img, _, err := image.Decode(bytes.NewReader(body))
 					require.NoError(t, err)
 					w := img.Bounds().Max.X
@@ -167,3 +252,847 @@ func TestMinipicServer(t *testing.T) {
 		}
 	}
 }
+
+func TestMinipicHash(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+	mp, closer := newMinipicServer()
+	defer closer()
+
+	tests := []struct {
+		url    string
+		status int
+		keys   []string
+	}{
+		{url: mp.URL + "/hash/" + is.URL + "/sample.jpeg", status: 200, keys: []string{"ahash", "dhash", "phash"}},
+		{
+			url:    mp.URL + "/hash/compare/" + is.URL + "/sample.jpeg/" + is.URL + "/sample.png",
+			status: 200,
+			keys:   []string{"distance", "hashes"},
+		},
+		{url: mp.URL + "/hash/" + is.URL + "/404", status: 404},
+		{url: mp.URL + "/hash/" + is.URL + "/sample.webp", status: 502},
+		{url: mp.URL + "/hash/compare/" + is.URL + "/sample.jpeg", status: 400},
+		{url: mp.URL + "/hash/invalid_img_url", status: 400},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.url, func(t *testing.T) {
+			result, data := get(t, tt.url)
+			require.Equal(t, tt.status, result.StatusCode)
+			if result.StatusCode != 200 {
+				return
+			}
+
+			require.Equal(t, "application/json", result.Header.Get("Content-Type"))
+			var body map[string]interface{}
+			require.NoError(t, json.Unmarshal(data, &body))
+			for _, key := range tt.keys {
+				require.Contains(t, body, key)
+			}
+		})
+	}
+}
+
+func TestMinipicSources(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	h := httpserver.NewHandler(
+		app.NewImageDownloader(allowLoopback()),
+		app.Resizer{},
+		httpserver.WithHasher(app.Hasher{}),
+		httpserver.WithSourcePolicy(httpserver.SourcePolicy{
+			Allow: []string{"127.0.0.*", "https://cdn.example.com/images/"},
+			Deny:  []string{is.URL + "/redirect/"},
+		}),
+	)
+	mp := httptest.NewServer(h)
+	defer mp.Close()
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{url: mp.URL + "/fit/800/600/" + is.URL + "/sample.png", status: 200},
+		{url: mp.URL + "/fit/800/600/" + is.URL + "/redirect/sample.jpeg", status: 403},
+		{url: mp.URL + "/fit/800/600/http://example.com/sample.png", status: 403},
+		{url: mp.URL + "/fit/800/600/https://cdn.example.com/other/sample.png", status: 403},
+		{url: mp.URL + "/hash/" + is.URL + "/sample.jpeg", status: 200},
+		{url: mp.URL + "/hash/compare/" + is.URL + "/sample.jpeg/http://example.com/sample.png", status: 403},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.url, func(t *testing.T) {
+			result, body := get(t, tt.url)
+			require.Equal(t, tt.status, result.StatusCode)
+			if result.StatusCode == http.StatusForbidden {
+				require.Contains(t, string(body), "image URL is not allowed")
+			}
+		})
+	}
+}
+
+func TestMinipicSignature(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	h := httpserver.NewHandler(
+		app.NewImageDownloader(allowLoopback()),
+		app.Resizer{},
+		httpserver.WithHasher(app.Hasher{}),
+		httpserver.WithSignature(map[string]string{"k1": "old-key", "k2": "new-key"}, false),
+	)
+	cache := app.NewLruCache("/tmp", 2)
+	defer cache.Clear()
+	mp := httptest.NewServer(middleware.NewCache(cache, h))
+	defer mp.Close()
+	unsafe := httptest.NewServer(httpserver.NewHandler(
+		app.NewImageDownloader(allowLoopback()),
+		app.Resizer{},
+		httpserver.WithSignature(map[string]string{"k2": "new-key"}, true),
+	))
+	defer unsafe.Close()
+
+	resize := "/fit/800/600/" + is.URL + "/sample.png"
+	hash := "/hash/" + is.URL + "/sample.jpeg"
+	expiring := fmt.Sprintf("/exp:%d/fill/300/300/%s/sample.png", time.Now().Add(time.Hour).Unix(), is.URL)
+	expired := fmt.Sprintf("/exp:%d/fill/300/300/%s/sample.png", time.Now().Add(-time.Second).Unix(), is.URL)
+
+	tests := []struct {
+		url     string
+		status  int
+		private bool
+	}{
+		{url: mp.URL + "/" + httpserver.Sign([]byte("new-key"), resize) + resize, status: 200},
+		{url: mp.URL + "/" + httpserver.Sign([]byte("old-key"), resize) + resize, status: 200},
+		{url: mp.URL + "/" + httpserver.Sign([]byte("new-key"), hash) + hash, status: 200},
+		{url: mp.URL + "/" + httpserver.Sign([]byte("other-key"), resize) + resize, status: 403},
+		{
+			url:    mp.URL + "/" + httpserver.Sign([]byte("new-key"), resize) + "/fit/800/800/" + is.URL + "/sample.png",
+			status: 403,
+		},
+		{url: mp.URL + resize, status: 403},
+		{url: mp.URL + "/unsafe" + resize, status: 403},
+		{url: unsafe.URL + "/unsafe" + resize, status: 200},
+		{url: unsafe.URL + "/" + httpserver.Sign([]byte("new-key"), resize) + resize, status: 200},
+		{url: unsafe.URL + resize, status: 403},
+		{url: mp.URL + "/k1." + httpserver.Sign([]byte("old-key"), resize) + resize, status: 200},
+		{url: mp.URL + "/k2." + httpserver.Sign([]byte("old-key"), resize) + resize, status: 403},
+		{url: mp.URL + "/k3." + httpserver.Sign([]byte("old-key"), resize) + resize, status: 403},
+		{url: mp.URL + "/k2." + httpserver.Sign([]byte("new-key"), expiring) + expiring, status: 200, private: true},
+		{url: mp.URL + "/k2." + httpserver.Sign([]byte("new-key"), expired) + expired, status: 410},
+		{url: mp.URL + "/k2." + httpserver.Sign([]byte("new-key"), resize) + expiring, status: 403},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.url, func(t *testing.T) {
+			// the expiring URLs must not be served from the cache
+			for n := 1; n <= 2; n++ {
+				result, _ := get(t, tt.url)
+				require.Equal(t, tt.status, result.StatusCode)
+				if tt.private {
+					require.Contains(t, result.Header.Get("Cache-Control"), "private")
+					require.Equal(t, "", result.Header.Get("X-Minipic-Cache"))
+				}
+			}
+		})
+	}
+}
+
+func TestMinipicUpload(t *testing.T) {
+	data, err := os.ReadFile("sample.jpeg")
+	require.NoError(t, err)
+
+	cache := app.NewLruCache("/tmp", 2)
+	defer cache.Clear()
+	mp := httptest.NewServer(middleware.NewCache(cache, httpserver.NewHandler(
+		app.NewImageDownloader(),
+		app.Resizer{},
+		// the limit leaves room for the multipart form
+		httpserver.WithUpload(int64(len(data)+1024)),
+	)))
+	defer mp.Close()
+	disabled := httptest.NewServer(httpserver.NewHandler(app.NewImageDownloader(), app.Resizer{}))
+	defer disabled.Close()
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	require.NoError(t, mw.WriteField("name", "sample"))
+	fw, err := mw.CreateFormFile("image", "sample.jpeg")
+	require.NoError(t, err)
+	fw.Write(data)
+	require.NoError(t, mw.Close())
+
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        []byte
+		chunked     bool
+		status      int
+	}{
+		{name: "body", url: mp.URL + "/fit/800/600", contentType: "image/jpeg", body: data, status: 200},
+		{
+			name:        "options",
+			url:         mp.URL + "/fill/300/300/progressive:1/max_bytes:40000/",
+			contentType: "image/jpeg",
+			body:        data,
+			status:      200,
+		},
+		{
+			name:        "multipart",
+			url:         mp.URL + "/fit/800/600",
+			contentType: mw.FormDataContentType(),
+			body:        form.Bytes(),
+			status:      200,
+		},
+		{
+			name:        "too large",
+			url:         mp.URL + "/fit/800/600",
+			contentType: "image/jpeg",
+			body:        append(data, make([]byte, 2048)...),
+			status:      413,
+		},
+		{
+			name:        "too large chunked",
+			url:         mp.URL + "/fit/800/600",
+			contentType: "image/jpeg",
+			body:        append(data, make([]byte, 2048)...),
+			chunked:     true,
+			status:      413,
+		},
+		{
+			name:        "no image field",
+			url:         mp.URL + "/fit/800/600",
+			contentType: "multipart/form-data; boundary=x",
+			body:        []byte("--x--\r\n"),
+			status:      400,
+		},
+		{name: "not an image", url: mp.URL + "/fit/800/600", contentType: "image/jpeg", body: []byte("text"), status: 422},
+		{
+			name:        "image URL",
+			url:         mp.URL + "/fit/800/600/http://example.com/image.jpeg",
+			contentType: "image/jpeg",
+			body:        data,
+			status:      400,
+		},
+		{name: "disabled", url: disabled.URL + "/fit/800/600", contentType: "image/jpeg", body: data, status: 405},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			// the uploads must not be served from the cache
+			for n := 1; n <= 2; n++ {
+				var body io.Reader = bytes.NewReader(tt.body)
+				if tt.chunked {
+					body = io.MultiReader(body)
+				}
+				result, data := request(t, http.MethodPost, tt.url, body, http.Header{"Content-Type": {tt.contentType}})
+				require.Equal(t, tt.status, result.StatusCode)
+				require.Equal(t, "", result.Header.Get("X-Minipic-Cache"))
+				if result.StatusCode != 200 {
+					continue
+				}
+				require.Equal(t, "image/jpeg", result.Header.Get("Content-Type"))
+				img, _, err := image.Decode(bytes.NewReader(data))
+				require.NoError(t, err)
+				require.LessOrEqual(t, img.Bounds().Dx(), 800)
+				require.LessOrEqual(t, img.Bounds().Dy(), 600)
+			}
+		})
+	}
+}
+
+func TestMinipicBatch(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	cache := app.NewLruCache("/tmp", 10)
+	defer cache.Clear()
+	newServer := func(opts ...httpserver.HandlerOption) *httptest.Server {
+		opts = append(opts, httpserver.WithCache(cache))
+		return httptest.NewServer(middleware.NewCache(cache, httpserver.NewHandler(
+			app.NewImageDownloader(allowLoopback()),
+			app.Resizer{},
+			opts...,
+		)))
+	}
+	mp := newServer()
+	defer mp.Close()
+	signed := newServer(httpserver.WithSignature(map[string]string{"k1": "key"}, false))
+	defer signed.Close()
+
+	tests := []struct {
+		name   string
+		server *httptest.Server
+		prefix func(uri string) string
+	}{
+		{name: "plain", server: mp, prefix: func(uri string) string { return uri }},
+		{name: "signed", server: signed, prefix: func(uri string) string {
+			return "/k1." + httpserver.Sign([]byte("key"), uri) + uri
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rest := "progressive:1/" + is.URL + "/sample.jpeg?" + tt.name
+			res, body := get(t, tt.server.URL+tt.prefix("/batch/fill:100:100,fill:200:200,fit:800:600/"+rest))
+			require.Equal(t, 200, res.StatusCode)
+			require.Equal(t, "test-server", res.Header.Get("X-Name"))
+
+			mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+			require.NoError(t, err)
+			require.Equal(t, "multipart/mixed", mediaType)
+
+			sizes := [][2]int{{100, 100}, {200, 200}, {800, 600}}
+			mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+			for i, size := range []string{"fill:100:100", "fill:200:200", "fit:800:600"} {
+				part, err := mr.NextPart()
+				require.NoError(t, err)
+				require.Equal(t, size, part.Header.Get("X-Minipic-Size"))
+				require.Equal(t, "image/jpeg", part.Header.Get("Content-Type"))
+				img, _, err := image.Decode(part)
+				require.NoError(t, err)
+				require.LessOrEqual(t, img.Bounds().Dx(), sizes[i][0])
+				require.LessOrEqual(t, img.Bounds().Dy(), sizes[i][1])
+
+				// the rendition is cached under the single-size URL
+				single := tt.prefix(fmt.Sprintf("/%s/%d/%d/%s", strings.Split(size, ":")[0], sizes[i][0], sizes[i][1], rest))
+				res, cached := get(t, tt.server.URL+single)
+				require.Equal(t, 200, res.StatusCode)
+				require.Equal(t, "HIT", res.Header.Get("X-Minipic-Cache"))
+				require.Equal(t, "image/jpeg", res.Header.Get("Content-Type"))
+				cachedImg, _, err := image.Decode(bytes.NewReader(cached))
+				require.NoError(t, err)
+				require.Equal(t, img.Bounds(), cachedImg.Bounds())
+			}
+			_, err = mr.NextPart()
+			require.Equal(t, io.EOF, err)
+		})
+	}
+
+	// the private image is not stored under the single-size URL
+	res, _ := get(t, mp.URL+"/batch/fill:100:100/"+is.URL+"/private/sample.jpeg")
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "private, max-age=60", res.Header.Get("Cache-Control"))
+	res, _ = get(t, mp.URL+"/fill/100/100/"+is.URL+"/private/sample.jpeg")
+	require.Equal(t, 200, res.StatusCode)
+	require.Empty(t, res.Header.Get("X-Minipic-Cache"))
+
+	for url, status := range map[string]int{
+		mp.URL + "/batch/" + is.URL + "/sample.jpeg":                        400,
+		mp.URL + "/batch/fill:100/" + is.URL + "/sample.jpeg":               400,
+		mp.URL + "/batch/crop:100:100/" + is.URL + "/sample.jpeg":           400,
+		mp.URL + "/batch/fill:100:100,fit:20:20/" + is.URL + "/404":         404,
+		mp.URL + "/batch/fill:100:100,fit:20:20/" + is.URL + "/sample.webp": 502,
+		signed.URL + "/batch/fill:100:100/" + is.URL + "/sample.jpeg":       403,
+	} {
+		res, _ := get(t, url)
+		require.Equal(t, status, res.StatusCode, url)
+	}
+}
+
+func TestMinipicSrcset(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	srcset := httpserver.Srcset{Breakpoints: []int{2560, 320, 640, 1280}, Sizes: "(max-width: 640px) 100vw, 50vw"}
+	newServer := func(opts ...httpserver.HandlerOption) *httptest.Server {
+		opts = append(opts, httpserver.WithSrcset(app.Inspector{}, srcset))
+		return httptest.NewServer(httpserver.NewHandler(app.NewImageDownloader(allowLoopback()), app.Resizer{}, opts...))
+	}
+	mp := newServer()
+	defer mp.Close()
+	signed := newServer(httpserver.WithSignature(map[string]string{"k1": "key"}, false))
+	defer signed.Close()
+	square := "/srcset/json/1:1/" + is.URL + "/sample.png"
+
+	// sample.png is 1920x1080
+	tests := []struct {
+		name   string
+		url    string
+		widths []int
+		height []int
+	}{
+		{
+			name:   "auto",
+			url:    mp.URL + "/srcset/json/auto/" + is.URL + "/sample.png",
+			widths: []int{320, 640, 1280},
+			height: []int{180, 360, 720},
+		},
+		{
+			name:   "square",
+			url:    mp.URL + "/srcset/json/1:1/palette:64/" + is.URL + "/sample.png",
+			widths: []int{320, 640},
+			height: []int{320, 640},
+		},
+		{
+			name:   "signed",
+			url:    signed.URL + "/k1." + httpserver.Sign([]byte("key"), square) + square,
+			widths: []int{320, 640},
+			height: []int{320, 640},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := get(t, tt.url)
+			require.Equal(t, 200, res.StatusCode)
+			require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+			// the URLs are built from the Host header of the request
+			require.Equal(t, "private", res.Header.Get("Cache-Control"))
+
+			var response struct {
+				Src        string
+				Srcset     string
+				Sizes      string
+				Type       string
+				Candidates []struct {
+					URL    string
+					Width  int
+					Height int
+				}
+			}
+			require.NoError(t, json.Unmarshal(body, &response))
+			require.Equal(t, srcset.Sizes, response.Sizes)
+			require.Equal(t, "image/png", response.Type)
+			require.Len(t, response.Candidates, len(tt.widths))
+			for i, c := range response.Candidates {
+				require.Equal(t, tt.widths[i], c.Width)
+				require.Equal(t, tt.height[i], c.Height)
+				require.Contains(t, response.Srcset, fmt.Sprintf("%s %dw", c.URL, c.Width))
+
+				// the candidate URLs are served by the same service
+				res, img := get(t, c.URL)
+				require.Equal(t, 200, res.StatusCode)
+				cfg, _, err := image.DecodeConfig(bytes.NewReader(img))
+				require.NoError(t, err)
+				require.Equal(t, c.Width, cfg.Width)
+				require.Equal(t, c.Height, cfg.Height)
+			}
+			require.Equal(t, response.Candidates[len(response.Candidates)-1].URL, response.Src)
+		})
+	}
+
+	res, body := get(t, mp.URL+"/srcset/img/16:9/"+is.URL+"/sample.png")
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	require.Regexp(t, `^<img src="[^"]+/fill/1280/720/[^"]+" width="1280" height="720" `+
+		`srcset="[^"]+ 320w, [^"]+ 640w, [^"]+ 1280w" sizes="[^"]+">$`, string(body))
+
+	res, body = get(t, mp.URL+"/srcset/picture/16:9/"+is.URL+"/sample.png")
+	require.Equal(t, 200, res.StatusCode)
+	require.Regexp(t, `^<picture><source type="image/png" srcset="[^"]+" sizes="[^"]+">`+
+		`<img [^>]+></picture>$`, string(body))
+
+	srcset.BaseURL = "https://img.example.com/"
+	based := newServer()
+	defer based.Close()
+	res, body = get(t, based.URL+"/srcset/img/16:9/"+is.URL+"/sample.png")
+	require.Equal(t, 200, res.StatusCode)
+	require.Empty(t, res.Header.Get("Cache-Control"))
+	require.Contains(t, string(body), `<img src="https://img.example.com/fill/1280/720/`)
+
+	for url, status := range map[string]int{
+		mp.URL + "/srcset/json/1:1/" + is.URL + "/404":            404,
+		mp.URL + "/srcset/json/1:1/" + is.URL + "/sample.webp":    502,
+		mp.URL + "/srcset/json/1x1/" + is.URL + "/sample.png":     400,
+		mp.URL + "/srcset/json/auto/" + is.URL + "/zero.jpeg":     502,
+		signed.URL + "/srcset/json/1:1/" + is.URL + "/sample.png": 403,
+	} {
+		res, _ := get(t, url)
+		require.Equal(t, status, res.StatusCode, url)
+	}
+}
+
+func TestMinipicSprite(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+	mp, closer := newMinipicServer()
+	defer closer()
+
+	sprite := func(query string, srcs ...string) string {
+		for _, src := range srcs {
+			query += "&url=" + url.QueryEscape(is.URL+src)
+		}
+		return mp.URL + "/sprite?" + query
+	}
+
+	uri := sprite("w=100&h=50&cols=3&format=png", "/sample.jpeg", "/sample.png", "/404", "/sample.jpeg", "/sample.webp")
+	res, body := get(t, uri)
+	require.Equal(t, 200, res.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "application/json", part.Header.Get("Content-Type"))
+	var tiles struct {
+		Width  int
+		Height int
+		Tiles  []struct {
+			URL    string
+			X      int
+			Y      int
+			Width  int
+			Height int
+			Error  string
+		}
+	}
+	require.NoError(t, json.NewDecoder(part).Decode(&tiles))
+	require.Equal(t, 300, tiles.Width)
+	require.Equal(t, 100, tiles.Height)
+	require.Len(t, tiles.Tiles, 5)
+	for i, tile := range tiles.Tiles {
+		require.Equal(t, i%3*100, tile.X)
+		require.Equal(t, i/3*50, tile.Y)
+		require.Equal(t, 100, tile.Width)
+		require.Equal(t, 50, tile.Height)
+	}
+	require.Equal(t, is.URL+"/404", tiles.Tiles[2].URL)
+	require.Contains(t, tiles.Tiles[2].Error, "404")
+	require.Contains(t, tiles.Tiles[4].Error, app.ErrUnsupportedFormat.Error())
+	require.Empty(t, tiles.Tiles[0].Error)
+
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "image/png", part.Header.Get("Content-Type"))
+	img, format, err := image.Decode(part)
+	require.NoError(t, err)
+	require.Equal(t, "png", format)
+	require.Equal(t, image.Rect(0, 0, 300, 100), img.Bounds())
+	// the failed tile is transparent, the resized one is not
+	_, _, _, a := img.At(250, 25).RGBA()
+	require.Equal(t, uint32(0), a)
+	_, _, _, a = img.At(50, 25).RGBA()
+	require.NotEqual(t, uint32(0), a)
+
+	for url, status := range map[string]int{
+		sprite("w=100&h=50", "/sample.jpeg"):              200,
+		sprite("w=100&h=50", "/404", "/500"):              502,
+		sprite("w=100", "/sample.jpeg"):                   400,
+		sprite("w=100&h=5", "/sample.jpeg"):               400,
+		sprite("w=100&h=50&cols=0", "/sample.jpeg"):       400,
+		sprite("w=100&h=50&format=webp", "/sample.jpeg"):  400,
+		sprite("w=5000&h=5000", "/sample.jpeg"):           400,
+		sprite("w=100&h=50&cols=1000000", "/sample.jpeg"): 400,
+		mp.URL + "/sprite?w=100&h=50":                     400,
+		mp.URL + "/sprite?w=100&h=50&url=invalid_img_url": 400,
+	} {
+		res, _ := get(t, url)
+		require.Equal(t, status, res.StatusCode, url)
+	}
+}
+
+// concurrentDownloader records the maximum number of the downloads at once.
+type concurrentDownloader struct {
+	httpserver.Downloader
+	active, peak *int32
+}
+
+func (d concurrentDownloader) Download(ctx context.Context, url string, headers http.Header) (*http.Response, error) {
+	active := atomic.AddInt32(d.active, 1)
+	defer atomic.AddInt32(d.active, -1)
+	for {
+		peak := atomic.LoadInt32(d.peak)
+		if active <= peak || atomic.CompareAndSwapInt32(d.peak, peak, active) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return d.Downloader.Download(ctx, url, headers)
+}
+
+func TestMinipicSpriteWorkers(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	var active, peak int32
+	mp := httptest.NewServer(httpserver.NewHandler(
+		concurrentDownloader{Downloader: app.NewImageDownloader(allowLoopback()), active: &active, peak: &peak},
+		app.Resizer{},
+	))
+	defer mp.Close()
+
+	query := "w=20&h=20"
+	for i := 0; i < 30; i++ {
+		query += "&url=" + url.QueryEscape(is.URL+"/sample.png")
+	}
+	res, _ := get(t, mp.URL+"/sprite?"+query)
+	require.Equal(t, 200, res.StatusCode)
+	require.LessOrEqual(t, atomic.LoadInt32(&peak), int32(8))
+	require.Greater(t, atomic.LoadInt32(&peak), int32(1))
+}
+
+func TestMinipicLocal(t *testing.T) {
+	mp := httptest.NewServer(httpserver.NewHandler(
+		app.SchemeDownloader{app.LocalScheme: app.NewLocalDownloader(".")},
+		app.Resizer{},
+		httpserver.WithSchemes(app.LocalScheme),
+	))
+	defer mp.Close()
+	disabled := httptest.NewServer(httpserver.NewHandler(app.NewImageDownloader(), app.Resizer{}))
+	defer disabled.Close()
+
+	for url, status := range map[string]int{
+		mp.URL + "/fit/800/600/local:///sample.png":       200,
+		mp.URL + "/fit/800/600/local:///missing.png":      404,
+		mp.URL + "/fit/800/600/local:///":                 400,
+		mp.URL + "/fit/800/600/local://":                  400,
+		mp.URL + "/fit/800/600/ftp:///sample.png":         400,
+		disabled.URL + "/fit/800/600/local:///sample.png": 400,
+	} {
+		res, body := get(t, url)
+		require.Equal(t, status, res.StatusCode, url)
+		if status == 200 {
+			require.Equal(t, "image/png", res.Header.Get("Content-Type"))
+			require.NotEmpty(t, res.Header.Get("Last-Modified"))
+			img, _, err := image.Decode(bytes.NewReader(body))
+			require.NoError(t, err)
+			require.Equal(t, 800, img.Bounds().Dx())
+		}
+	}
+}
+
+func TestMinipicOrigin(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	origins := map[string]app.Origin{
+		"products": {Base: is.URL + "/chunked/", Headers: map[string]string{"X-Api-Key": "secret"}, Timeout: 5 * time.Second},
+		"root":     {Base: is.URL},
+	}
+	mp := httptest.NewServer(httpserver.NewHandler(
+		app.SchemeDownloader{httpserver.OriginScheme: app.NewOriginDownloader(origins)},
+		app.Resizer{},
+		httpserver.WithOrigins("products", "root"),
+	))
+	defer mp.Close()
+
+	for url, status := range map[string]int{
+		mp.URL + "/fit/800/600/@products/sample.jpeg": 200,
+		mp.URL + "/fit/800/600/@root/sample.png":      200,
+		// the path can not leave the base
+		mp.URL + "/fit/800/600/@products/../sample.jpeg": 200,
+		mp.URL + "/fit/800/600/@products/missing.jpeg":   404,
+		mp.URL + "/fit/800/600/@other/sample.jpeg":       400,
+		// the downloader has no http(s) images
+		mp.URL + "/fit/800/600/" + is.URL + "/sample.png": 502,
+	} {
+		res, body := get(t, url)
+		require.Equal(t, status, res.StatusCode, url)
+		if status == 200 {
+			img, _, err := image.Decode(bytes.NewReader(body))
+			require.NoError(t, err)
+			require.Equal(t, 800, img.Bounds().Dx())
+		}
+	}
+
+	res, _ := get(t, mp.URL+"/fit/800/600/@products/sample.jpeg")
+	require.Equal(t, "secret", res.Header.Get("X-From-X-Api-Key"))
+}
+
+// countingDownloader counts the downloads.
+type countingDownloader struct {
+	httpserver.Downloader
+	count *int32
+}
+
+func (d countingDownloader) Download(ctx context.Context, url string, headers http.Header) (*http.Response, error) {
+	atomic.AddInt32(d.count, 1)
+	return d.Downloader.Download(ctx, url, headers)
+}
+
+func TestMinipicFallback(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	origins := map[string]app.Origin{
+		"missing": {Base: is.URL + "/missing/", Fallbacks: []string{"slow", "backup"}},
+		"slow":    {Base: is.URL + "/slow/", Timeout: 100 * time.Millisecond, Fallbacks: []string{"backup"}},
+		"failing": {Base: is.URL + "/500/", Fallbacks: []string{"missing"}},
+		"backup":  {Base: is.URL},
+	}
+	placeholder, err := os.ReadFile("sample_v.png")
+	require.NoError(t, err)
+
+	var downloads int32
+	cache := app.NewLruCache("/tmp", 10)
+	defer cache.Clear()
+	mp := httptest.NewServer(middleware.NewCache(cache, httpserver.NewHandler(
+		countingDownloader{
+			Downloader: app.SchemeDownloader{
+				"http":                  app.NewImageDownloader(allowLoopback()),
+				httpserver.OriginScheme: app.NewOriginDownloader(origins),
+			},
+			count: &downloads,
+		},
+		app.Resizer{},
+		httpserver.WithOrigins("missing", "slow", "failing", "backup"),
+		httpserver.WithPlaceholder(placeholder, time.Minute),
+	)))
+	defer mp.Close()
+
+	for _, url := range []string{
+		mp.URL + "/fit/800/600/@missing/sample.jpeg",
+		mp.URL + "/fit/800/600/@slow/sample.jpeg",
+	} {
+		res, body := get(t, url)
+		require.Equal(t, 200, res.StatusCode, url)
+		require.Empty(t, res.Header.Get(httpserver.PlaceholderHeader), url)
+		require.Equal(t, "image/jpeg", res.Header.Get("Content-Type"), url)
+		img, _, err := image.Decode(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, 800, img.Bounds().Dx())
+	}
+
+	// the fallbacks of the fallback are not tried, the placeholder is served instead
+	for _, url := range []string{
+		mp.URL + "/fill/200/100/@failing/sample.jpeg",
+		mp.URL + "/fill/200/100/@backup/missing.jpeg",
+		mp.URL + "/fill/200/100/" + is.URL + "/500",
+		mp.URL + "/fill/200/100/http://127.0.0.1:1/sample.jpeg",
+	} {
+		res, body := get(t, url)
+		require.Equal(t, 200, res.StatusCode, url)
+		require.Equal(t, "true", res.Header.Get(httpserver.PlaceholderHeader), url)
+		require.Equal(t, "public, max-age=60", res.Header.Get("Cache-Control"), url)
+		require.Equal(t, "image/png", res.Header.Get("Content-Type"), url)
+		require.Empty(t, res.Header.Get("X-Error"), url)
+		img, _, err := image.Decode(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 200, 100), img.Bounds())
+	}
+
+	// the placeholder is not cached
+	atomic.StoreInt32(&downloads, 0)
+	get(t, mp.URL+"/fill/200/100/@backup/missing.jpeg")
+	require.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+
+	// the request errors and the images rejected by the service are not hidden
+	for url, status := range map[string]int{
+		mp.URL + "/fill/200/100/@unknown/sample.jpeg":      400,
+		mp.URL + "/fill/200/100/http://10.0.0.1/image.jpg": 403,
+		mp.URL + "/fill/200/100/" + is.URL + "/403":        403,
+	} {
+		res, _ := get(t, url)
+		require.Equal(t, status, res.StatusCode, url)
+		require.Empty(t, res.Header.Get(httpserver.PlaceholderHeader), url)
+	}
+}
+
+func TestMinipicTimeout(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	mp := httptest.NewServer(httpserver.NewHandler(
+		app.NewImageDownloader(allowLoopback()),
+		app.Resizer{},
+		httpserver.WithTimeout(500*time.Millisecond),
+	))
+	defer mp.Close()
+
+	res, _ := get(t, mp.URL+"/fit/800/600/"+is.URL+"/sample.jpeg")
+	require.Equal(t, 200, res.StatusCode)
+
+	start := time.Now()
+	res, _ = get(t, mp.URL+"/fit/800/600/"+is.URL+"/slow/sample.jpeg")
+	require.Equal(t, 502, res.StatusCode)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestMinipicHeaders(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+
+	newServer := func(opts ...httpserver.HandlerOption) *httptest.Server {
+		return httptest.NewServer(httpserver.NewHandler(app.NewImageDownloader(allowLoopback()), app.Resizer{}, opts...))
+	}
+	defaults := newServer()
+	defer defaults.Close()
+	custom := newServer(httpserver.WithHeaderPolicy(
+		httpserver.HeaderPolicy{Allow: []string{"Cookie", "User-Agent"}, Deny: []string{"User-Agent"}},
+		httpserver.HeaderPolicy{Allow: []string{"Set-Cookie", "Content-Type"}},
+	))
+	defer custom.Close()
+
+	download := func(server *httptest.Server) *http.Response {
+		res, _ := request(t, http.MethodGet, server.URL+"/fit/100/100/"+is.URL+"/cookie/sample.jpeg", nil, http.Header{
+			"User-Agent":    {"Firefox"},
+			"Cookie":        {"session=secret"},
+			"Authorization": {"Bearer secret"},
+		})
+		require.Equal(t, 200, res.StatusCode)
+		return res
+	}
+
+	res := download(defaults)
+	require.Equal(t, "Firefox", res.Header.Get("X-From-User-Agent"))
+	require.Empty(t, res.Header.Get("X-From-Cookie"))
+	require.Empty(t, res.Header.Get("X-From-Authorization"))
+	require.Equal(t, "test-server", res.Header.Get("X-Name"))
+	require.Empty(t, res.Header.Get("Set-Cookie"))
+	require.Empty(t, res.Header.Get("Strict-Transport-Security"))
+
+	res = download(custom)
+	require.Empty(t, res.Header.Get("X-From-User-Agent"))
+	require.Empty(t, res.Header.Get("X-Name"))
+	require.Equal(t, "tracking=1", res.Header.Get("Set-Cookie"))
+	require.Equal(t, "image/jpeg", res.Header.Get("Content-Type"))
+}
+
+func TestMinipicCredentials(t *testing.T) {
+	is := newImageServer()
+	defer is.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(is.URL, "http://"))
+	require.NoError(t, err)
+
+	credentials := map[string]app.Credentials{"localhost": {Token: "host-token"}}
+	origins := map[string]app.Origin{
+		"basic":  {Base: is.URL, Auth: app.Credentials{Username: "user", Password: "pass"}},
+		"apikey": {Base: is.URL, Auth: app.Credentials{Headers: map[string]string{"X-Api-Key": "key"}}},
+		"public": {Base: is.URL},
+	}
+	remote := app.NewImageDownloader(allowLoopback(), app.WithCredentials(credentials))
+	mp := httptest.NewServer(httpserver.NewHandler(
+		app.SchemeDownloader{
+			"http":                  remote,
+			httpserver.OriginScheme: app.NewOriginDownloader(origins),
+		},
+		app.Resizer{},
+		httpserver.WithOrigins("basic", "apikey", "public"),
+		// even if the client credentials are allowed by the policy, they are not forwarded
+		httpserver.WithHeaderPolicy(httpserver.HeaderPolicy{}, httpserver.HeaderPolicy{}),
+	))
+	defer mp.Close()
+
+	tests := []struct {
+		src           string
+		authorization string
+		apiKey        string
+	}{
+		{src: "http://localhost:" + port + "/sample.jpeg", authorization: "Bearer host-token", apiKey: "client"},
+		{src: is.URL + "/sample.jpeg", apiKey: "client"},
+		{src: "@basic/sample.jpeg", authorization: "Basic dXNlcjpwYXNz", apiKey: "client"},
+		{src: "@apikey/sample.jpeg", apiKey: "key"},
+		{src: "@public/sample.jpeg", apiKey: "client"},
+	}
+	for _, tt := range tests {
+		res, _ := request(t, http.MethodGet, mp.URL+"/fit/100/100/"+tt.src, nil, http.Header{
+			"Authorization": {"Bearer client"},
+			"X-Api-Key":     {"client"},
+		})
+		require.Equal(t, 200, res.StatusCode, tt.src)
+		require.Equal(t, tt.authorization, res.Header.Get("X-From-Authorization"), tt.src)
+		require.Equal(t, tt.apiKey, res.Header.Get("X-From-X-Api-Key"), tt.src)
+	}
+}
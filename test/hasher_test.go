@@ -0,0 +1,55 @@
+package test
+
+import (
+	"bytes"
+	"math/bits"
+	"os"
+	"testing"
+
+	"github.com/bardex/minipic/internal/app"
+	"github.com/bardex/minipic/internal/httpserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasher(t *testing.T) {
+	t.Parallel()
+
+	hasher := app.Hasher{}
+
+	hashFile := func(t *testing.T, file string) httpserver.ImageHash {
+		t.Helper()
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		defer f.Close()
+		hash, err := hasher.Hash(f)
+		require.NoError(t, err)
+		return hash
+	}
+
+	original := hashFile(t, "sample.jpeg")
+	require.Equal(t, original, hashFile(t, "sample.jpeg"))
+
+	// a resized copy of the same picture must be close to the original
+	src, err := os.Open("sample.jpeg")
+	require.NoError(t, err)
+	defer src.Close()
+	var thumb bytes.Buffer
+	_, err = app.Resizer{}.Resize(src, &thumb, httpserver.ResizeOptions{Mode: "fit", Width: 400, Height: 400})
+	require.NoError(t, err)
+	resized, err := hasher.Hash(&thumb)
+	require.NoError(t, err)
+
+	require.LessOrEqual(t, bits.OnesCount64(original.AHash^resized.AHash), 5)
+	require.LessOrEqual(t, bits.OnesCount64(original.DHash^resized.DHash), 5)
+	require.LessOrEqual(t, bits.OnesCount64(original.PHash^resized.PHash), 5)
+
+	// a different picture must be far from the original
+	other := hashFile(t, "sample_v.png")
+	require.Greater(t, bits.OnesCount64(original.PHash^other.PHash), 10)
+
+	f, err := os.Open("sample.webp")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = hasher.Hash(f)
+	require.ErrorIs(t, err, app.ErrUnsupportedFormat)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"io"
 	"os"
 	"testing"
 
@@ -46,7 +47,7 @@ func TestResizer(t *testing.T) {
 
 			var dst bytes.Buffer
 
-			err = resizer.Resize(src, &dst, httpserver.ResizeOptions{Mode: tt.mode, Width: tt.width, Height: tt.height})
+			_, err = resizer.Resize(src, &dst, httpserver.ResizeOptions{Mode: tt.mode, Width: tt.width, Height: tt.height})
 			if tt.err != nil {
 				require.ErrorIs(t, err, tt.err)
 				return
@@ -74,3 +75,213 @@ func TestResizer(t *testing.T) {
 		})
 	}
 }
+
+func TestResizerEncodingOptions(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		file string
+		opts httpserver.ResizeOptions
+	}{
+		{
+			name: "progressive jpeg",
+			file: "sample.jpeg",
+			opts: httpserver.ResizeOptions{Mode: "fill", Width: 333, Height: 201, Progressive: true},
+		},
+		{
+			name: "progressive vertical jpeg",
+			file: "sample.jpeg",
+			opts: httpserver.ResizeOptions{Mode: "fit", Width: 99, Height: 777, Progressive: true},
+		},
+		{
+			name: "palette png",
+			file: "sample.png",
+			opts: httpserver.ResizeOptions{Mode: "fill", Width: 400, Height: 300, Palette: 256},
+		},
+		{
+			name: "small palette png",
+			file: "sample_v.png",
+			opts: httpserver.ResizeOptions{Mode: "fit", Width: 400, Height: 300, Palette: 16},
+		},
+	}
+
+	resizer := app.Resizer{}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			data, err := os.ReadFile(tt.file)
+			require.NoError(t, err)
+
+			var plain, optimized bytes.Buffer
+			plainOpts := httpserver.ResizeOptions{Mode: tt.opts.Mode, Width: tt.opts.Width, Height: tt.opts.Height}
+			_, err = resizer.Resize(bytes.NewReader(data), &plain, plainOpts)
+			require.NoError(t, err)
+			_, err = resizer.Resize(bytes.NewReader(data), &optimized, tt.opts)
+			require.NoError(t, err)
+
+			expected, _, err := image.Decode(bytes.NewReader(plain.Bytes()))
+			require.NoError(t, err)
+			img, _, err := image.Decode(bytes.NewReader(optimized.Bytes()))
+			require.NoError(t, err)
+			require.Equal(t, expected.Bounds(), img.Bounds())
+
+			if tt.opts.Progressive {
+				// SOF2 marker: progressive DCT
+				require.True(t, bytes.Contains(optimized.Bytes(), []byte{0xff, 0xc2}))
+				// the picture must be the same as the baseline one
+				center := image.Pt(img.Bounds().Dx()/2, img.Bounds().Dy()/2)
+				r1, g1, b1, _ := expected.At(center.X, center.Y).RGBA()
+				r2, g2, b2, _ := img.At(center.X, center.Y).RGBA()
+				require.InDelta(t, r1>>8, r2>>8, 16)
+				require.InDelta(t, g1>>8, g2>>8, 16)
+				require.InDelta(t, b1>>8, b2>>8, 16)
+			}
+			if tt.opts.Palette > 0 {
+				paletted, ok := img.(*image.Paletted)
+				require.True(t, ok)
+				require.LessOrEqual(t, len(paletted.Palette), tt.opts.Palette)
+				require.Less(t, optimized.Len(), plain.Len())
+			}
+		})
+	}
+}
+
+func TestResizerMaxBytes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		maxBytes int
+		quality  int
+		err      error
+	}{
+		{name: "no limit", maxBytes: 0, quality: 85},
+		{name: "large limit", maxBytes: 10000000, quality: 85},
+		{name: "small limit", maxBytes: 30000},
+		{name: "unreachable limit", maxBytes: 500, err: httpserver.ErrMaxBytesUnreachable},
+	}
+
+	data, err := os.ReadFile("sample.jpeg")
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			for _, progressive := range []bool{false, true} {
+				var dst bytes.Buffer
+				opts := httpserver.ResizeOptions{
+					Mode: "fit", Width: 800, Height: 800, MaxBytes: tt.maxBytes, Progressive: progressive,
+				}
+				result, err := app.Resizer{}.Resize(bytes.NewReader(data), &dst, opts)
+				if tt.err != nil {
+					require.ErrorIs(t, err, tt.err)
+					continue
+				}
+				require.NoError(t, err)
+
+				if tt.quality > 0 {
+					require.Equal(t, tt.quality, result.Quality)
+				} else {
+					require.Less(t, result.Quality, 85)
+					require.Greater(t, result.Quality, 0)
+				}
+				if tt.maxBytes > 0 {
+					require.LessOrEqual(t, dst.Len(), tt.maxBytes)
+				}
+				_, _, err = image.Decode(&dst)
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestResizerLimits(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		resizer app.Resizer
+		opts    httpserver.ResizeOptions
+		err     error
+	}{
+		{name: "no limits", resizer: app.Resizer{}, opts: httpserver.ResizeOptions{Mode: "fit", Width: 800, Height: 800}},
+		{
+			name:    "source within limit",
+			resizer: app.Resizer{MaxSourcePixels: 1920 * 1080},
+			opts:    httpserver.ResizeOptions{Mode: "fit", Width: 800, Height: 800},
+		},
+		{
+			name:    "source over limit",
+			resizer: app.Resizer{MaxSourcePixels: 1920*1080 - 1},
+			opts:    httpserver.ResizeOptions{Mode: "fit", Width: 800, Height: 800},
+			err:     httpserver.ErrSourceResolution,
+		},
+		{
+			name:    "output over limit",
+			resizer: app.Resizer{MaxOutputPixels: 1000 * 1000},
+			opts:    httpserver.ResizeOptions{Mode: "fit", Width: 4000, Height: 4000},
+			err:     httpserver.ErrOutputResolution,
+		},
+		{
+			// fill resizes the image before cropping
+			name:    "uncropped fill over limit",
+			resizer: app.Resizer{MaxOutputPixels: 1000 * 1000},
+			opts:    httpserver.ResizeOptions{Mode: "fill", Width: 10, Height: 2000},
+			err:     httpserver.ErrOutputResolution,
+		},
+	}
+
+	data, err := os.ReadFile("sample.jpeg")
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var dst bytes.Buffer
+			_, err := tt.resizer.Resize(bytes.NewReader(data), &dst, tt.opts)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestResizerBatch(t *testing.T) {
+	t.Parallel()
+	data, err := os.ReadFile("sample.jpeg")
+	require.NoError(t, err)
+
+	opts := []httpserver.ResizeOptions{
+		{Mode: "fill", Width: 100, Height: 100},
+		{Mode: "fill", Width: 200, Height: 200},
+		{Mode: "fit", Width: 800, Height: 600, Progressive: true},
+		{Mode: "fit", Width: 300, Height: 300, MaxBytes: 10000},
+	}
+	imgs := make([]bytes.Buffer, len(opts))
+	dsts := make([]io.Writer, len(opts))
+	for i := range imgs {
+		dsts[i] = &imgs[i]
+	}
+
+	resizer := app.Resizer{}
+	results, err := resizer.ResizeBatch(bytes.NewReader(data), dsts, opts)
+	require.NoError(t, err)
+	require.Len(t, results, len(opts))
+
+	for i, o := range opts {
+		// every rendition must be the same as the single resize
+		var single bytes.Buffer
+		result, err := resizer.Resize(bytes.NewReader(data), &single, o)
+		require.NoError(t, err)
+		require.Equal(t, result, results[i])
+		require.Equal(t, single.Bytes(), imgs[i].Bytes())
+	}
+
+	tiny := []httpserver.ResizeOptions{{Mode: "fit", Width: 10, Height: 10, MaxBytes: 10}}
+	_, err = resizer.ResizeBatch(bytes.NewReader(data), dsts[:1], tiny)
+	require.ErrorIs(t, err, httpserver.ErrMaxBytesUnreachable)
+}